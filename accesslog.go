@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	commonLogFormat   = `{{.Host}} - {{.User}} [{{.Time.Format "02/Jan/2006:15:04:05 -0700"}}] "{{.Request}}" {{.Status}} {{if .Bytes}}{{.Bytes}}{{else}}-{{end}}`
+	combinedLogFormat = commonLogFormat + ` "{{.Referer}}" "{{.UserAgent}}"`
+)
+
+// accessLogEntry is what templates of the access log format can use. Strings
+// are escaped, so that they can be quoted and never span lines.
+type accessLogEntry struct {
+	Host      string
+	User      string
+	Time      time.Time
+	Method    string
+	URI       string
+	Proto     string
+	Request   string
+	Route     string
+	Status    int
+	Bytes     int64
+	Latency   time.Duration
+	Referer   string
+	UserAgent string
+	RequestID string
+}
+
+// accessLogger writes a line for every request to a file, in Common or
+// Combined Log Format or in a custom template.
+type accessLogger struct {
+	tmpl *template.Template
+	out  *rotatingFile
+}
+
+// parseAccessLogFormat parses a named format or a template.
+func parseAccessLogFormat(format string) (*template.Template, error) {
+	switch format {
+	case "common":
+		format = commonLogFormat
+	case "combined":
+		format = combinedLogFormat
+	}
+	return template.New("access_log").Parse(format)
+}
+
+func newAccessLogger(cfg accessLogConfig) (*accessLogger, error) {
+	tmpl, err := parseAccessLogFormat(cfg.Format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format: %v", err)
+	}
+
+	out, err := openRotatingFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accessLogger{tmpl: tmpl, out: out}, nil
+}
+
+// escapeLogValue escapes quotes, backslashes and control characters, or
+// returns "-" for empty values.
+func escapeLogValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+func (l *accessLogger) log(r *http.Request, rec *responseRecorder, info *requestLogInfo, start time.Time) {
+	entry := accessLogEntry{
+		Host:      escapeLogValue(clientIP(r)),
+		User:      escapeLogValue(info.user),
+		Time:      start,
+		Method:    escapeLogValue(r.Method),
+		URI:       escapeLogValue(r.RequestURI),
+		Proto:     escapeLogValue(r.Proto),
+		Request:   escapeLogValue(r.Method + " " + r.RequestURI + " " + r.Proto),
+		Route:     escapeLogValue(info.pattern),
+		Status:    rec.statusCode,
+		Bytes:     rec.bytes,
+		Latency:   time.Since(start),
+		Referer:   escapeLogValue(r.Referer()),
+		UserAgent: escapeLogValue(r.UserAgent()),
+		RequestID: escapeLogValue(requestID(r)),
+	}
+
+	var buf bytes.Buffer
+	if err := l.tmpl.Execute(&buf, entry); err != nil {
+		requestLogger(r).Error("Failed to format access log entry", "error", err)
+		return
+	}
+	buf.WriteByte('\n')
+
+	if _, err := l.out.Write(buf.Bytes()); err != nil {
+		requestLogger(r).Error("Failed to write access log", "error", err)
+	}
+}
+
+// backupTimeFormat is the time of the rotation in the names of backups.
+const backupTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a log file that is rotated when it grows larger than
+// MaxSizeMB or older than MaxAge. Rotated files are renamed with the time of
+// the rotation, optionally compressed, and the oldest are removed beyond
+// MaxBackups.
+type rotatingFile struct {
+	cfg accessLogConfig
+
+	mu sync.Mutex
+	// f is nil when opening the file failed, it's opened again by the next
+	// write
+	f      *os.File
+	size   int64
+	opened time.Time
+	closed bool
+
+	// Backups are processed one run at a time by a single goroutine, woken
+	// up after rotations, so that a backup isn't removed while it's being
+	// compressed
+	rotated   chan struct{}
+	processed chan struct{}
+}
+
+func openRotatingFile(cfg accessLogConfig) (*rotatingFile, error) {
+	cfg.File = filepath.Clean(cfg.File)
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0o750); err != nil {
+		return nil, err
+	}
+
+	rf := &rotatingFile{cfg: cfg, rotated: make(chan struct{}, 1), processed: make(chan struct{})}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	go rf.processBackups()
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, fmt.Errorf("open: %v", err)
+		}
+	}
+
+	maxSize := int64(rf.cfg.MaxSizeMB) << 20
+	tooLarge := maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > maxSize
+	tooOld := rf.cfg.MaxAge > 0 && time.Since(rf.opened) > time.Duration(rf.cfg.MaxAge)
+	if tooLarge || tooOld {
+		if err := rf.rotate(); err != nil {
+			return 0, fmt.Errorf("rotate: %v", err)
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one. When it fails, the
+// file is left closed and opened again by the next write.
+func (rf *rotatingFile) rotate() error {
+	err := rf.f.Close()
+	rf.f = nil
+	if err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(rf.cfg.File)
+	backup := strings.TrimSuffix(rf.cfg.File, ext) + "-" + time.Now().UTC().Format(backupTimeFormat) + ext
+	if err := os.Rename(rf.cfg.File, backup); err != nil {
+		return err
+	}
+
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	// A pending run will process this backup too
+	select {
+	case rf.rotated <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// processBackups compresses the new backups and removes the oldest ones
+// after every rotation, until the file is closed.
+func (rf *rotatingFile) processBackups() {
+	defer close(rf.processed)
+
+	for range rf.rotated {
+		backups, err := rf.backups()
+		if err != nil {
+			slog.Error("Failed to list access log backups", "error", err)
+			continue
+		}
+
+		if rf.cfg.Compress {
+			for i, backup := range backups {
+				if strings.HasSuffix(backup, ".gz") {
+					continue
+				}
+				if err := compressFile(backup); err != nil {
+					slog.Error("Failed to compress access log", "file", backup, "error", err)
+					continue
+				}
+				backups[i] = backup + ".gz"
+			}
+		}
+
+		if rf.cfg.MaxBackups <= 0 {
+			continue
+		}
+
+		// The names sort by the time of the rotation
+		slices.Sort(backups)
+		for len(backups) > rf.cfg.MaxBackups {
+			if err := os.Remove(backups[0]); err != nil {
+				slog.Error("Failed to remove access log backup", "file", backups[0], "error", err)
+			}
+			backups = backups[1:]
+		}
+	}
+}
+
+// backups lists the backups of the file, compressed or not. Only names with
+// the time of a rotation match, so that other files next to the log are left
+// alone.
+func (rf *rotatingFile) backups() ([]string, error) {
+	ext := filepath.Ext(rf.cfg.File)
+	prefix := strings.TrimSuffix(rf.cfg.File, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, name := range matches {
+		timestamp, found := strings.CutSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		if !found {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, timestamp); err != nil {
+			continue
+		}
+		backups = append(backups, name)
+	}
+	return backups, nil
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(filepath.Clean(name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(filepath.Clean(name+".gz"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(filepath.Clean(name))
+}
+
+// reopen closes and reopens the file, after it was moved by an external tool
+// like logrotate.
+func (rf *rotatingFile) reopen() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return os.ErrClosed
+	}
+	if rf.f != nil {
+		if err := rf.f.Close(); err != nil {
+			slog.Error("Failed to close access log", "error", err)
+		}
+		rf.f = nil
+	}
+	return rf.open()
+}
+
+// Close closes the file and waits for the backups being processed.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.closed {
+		return nil
+	}
+	rf.closed = true
+
+	var err error
+	if rf.f != nil {
+		err = rf.f.Close()
+		rf.f = nil
+	}
+	close(rf.rotated)
+	<-rf.processed
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// reopenOnSignal does nothing on systems without SIGUSR1.
+func (l *accessLogger) reopenOnSignal() {}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenOnSignal reopens the access log file on SIGUSR1, e.g. from the
+// postrotate script of logrotate.
+func (l *accessLogger) reopenOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+
+	go func() {
+		for range c {
+			if err := l.out.reopen(); err != nil {
+				slog.Error("Failed to reopen access log", "error", err)
+				continue
+			}
+			slog.Info("Reopened access log")
+		}
+	}()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	scopePostsRead   = "posts:read"
+	scopePostsWrite  = "posts:write"
+	scopePostsDelete = "posts:delete"
+
+	// scopeKeysManage can't be granted to API keys, so only users are
+	// allowed to manage them.
+	scopeKeysManage = "keys:manage"
+)
+
+// apiKeyScopes are the scopes that can be granted to an API key.
+var apiKeyScopes = []string{scopePostsRead, scopePostsWrite, scopePostsDelete, scopeMetricsRead}
+
+// apiKeyPrefix makes keys recognizable in logs and secret scanners.
+const apiKeyPrefix = "hsk_"
+
+var errAPIKeyNotFound = errors.New("API key not found")
+
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+// apiKeyStore keeps API keys. Only the SHA-256 hash of a key is stored, the
+// key itself is shown once when it's created.
+type apiKeyStore interface {
+	create(ctx context.Context, key apiKey, hash string) error
+	list(ctx context.Context) ([]apiKey, error)
+	// lookup returns the key with the hash and records that it was used.
+	lookup(ctx context.Context, hash string) (apiKey, error)
+	revoke(ctx context.Context, id string) error
+}
+
+type memoryAPIKeyStore struct {
+	mu     sync.Mutex
+	keys   map[string]apiKey
+	hashes map[string]string
+}
+
+func newMemoryAPIKeyStore() *memoryAPIKeyStore {
+	return &memoryAPIKeyStore{keys: map[string]apiKey{}, hashes: map[string]string{}}
+}
+
+func (s *memoryAPIKeyStore) create(ctx context.Context, key apiKey, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[key.ID] = key
+	s.hashes[hash] = key.ID
+	return nil
+}
+
+func (s *memoryAPIKeyStore) list(ctx context.Context) ([]apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []apiKey{}
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+func (s *memoryAPIKeyStore) lookup(ctx context.Context, hash string) (apiKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, exists := s.hashes[hash]
+	if !exists {
+		return apiKey{}, errAPIKeyNotFound
+	}
+
+	key := s.keys[id]
+	now := time.Now()
+	key.LastUsedAt = &now
+	s.keys[id] = key
+
+	return key, nil
+}
+
+func (s *memoryAPIKeyStore) revoke(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.keys[id]; !exists {
+		return errAPIKeyNotFound
+	}
+
+	delete(s.keys, id)
+	for hash, keyID := range s.hashes {
+		if keyID == id {
+			delete(s.hashes, hash)
+		}
+	}
+	return nil
+}
+
+type postgresAPIKeyStore struct {
+	db *pgxpool.Pool
+}
+
+func (s *postgresAPIKeyStore) create(ctx context.Context, key apiKey, hash string) error {
+	_, err := s.db.Exec(ctx, "INSERT INTO api_keys(id, name, hash, scopes, created_at) VALUES ($1, $2, $3, $4, $5)",
+		key.ID, key.Name, hash, key.Scopes, key.CreatedAt,
+	)
+	return err
+}
+
+func (s *postgresAPIKeyStore) list(ctx context.Context) ([]apiKey, error) {
+	rows, err := s.db.Query(ctx, "SELECT id, name, scopes, created_at, last_used_at FROM api_keys WHERE revoked_at IS NULL ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[apiKey])
+}
+
+func (s *postgresAPIKeyStore) lookup(ctx context.Context, hash string) (apiKey, error) {
+	var key apiKey
+	err := s.db.QueryRow(ctx, "UPDATE api_keys SET last_used_at = now() WHERE hash = $1 AND revoked_at IS NULL RETURNING id, name, scopes, created_at, last_used_at", hash).Scan(
+		&key.ID, &key.Name, &key.Scopes, &key.CreatedAt, &key.LastUsedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *postgresAPIKeyStore) revoke(ctx context.Context, id string) error {
+	tag, err := s.db.Exec(ctx, "UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (app *application) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeProblem(w, r, http.StatusBadRequest, "Missing field: name")
+		return
+	}
+	if err := checkLength("name", req.Name, maxKeyNameLength); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Missing field: scopes")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown scope: %s (must be one of %s)", scope, strings.Join(apiKeyScopes, ", ")))
+			return
+		}
+	}
+
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		requestLogger(r).Error("Failed to generate API key", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	id := hex.EncodeToString(b[:8])
+	secret := apiKeyPrefix + hex.EncodeToString(b[8:])
+
+	key := apiKey{
+		ID:        id,
+		Name:      req.Name,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := app.apiKeys.create(r.Context(), key, hashAPIKey(secret)); err != nil {
+		requestLogger(r).Error("Failed to store API key", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+
+	err := json.NewEncoder(w).Encode(struct {
+		apiKey
+		Key string `json:"key"`
+	}{key, secret})
+	if err != nil {
+		requestLogger(r).Error("Failed to encode API key", "error", err)
+		return
+	}
+}
+
+func (app *application) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.apiKeys.list(r.Context())
+	if err != nil {
+		requestLogger(r).Error("Failed to list API keys", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(keys)
+	if err != nil {
+		requestLogger(r).Error("Failed to encode API keys", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+}
+
+func (app *application) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	err := app.apiKeys.revoke(r.Context(), r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, errAPIKeyNotFound) {
+			writeProblem(w, r, http.StatusNotFound, "API key not found")
+			return
+		}
+		requestLogger(r).Error("Failed to revoke API key", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the smallest body worth compressing. Smaller bodies
+// grow rather than shrink with the encoding overhead.
+const minCompressSize = 1024
+
+// compressionWriter is a compressor that can be reused for other responses.
+type compressionWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// contentEncodings are the supported encodings, in order of preference when
+// the client accepts several equally.
+var contentEncodings = []struct {
+	name string
+	pool *sync.Pool
+}{
+	{"zstd", &sync.Pool{New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}}},
+	{"br", &sync.Pool{New: func() any {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}}},
+	{"gzip", &sync.Pool{New: func() any {
+		return gzip.NewWriter(nil)
+	}}},
+}
+
+// acceptedEncodings returns the quality of each encoding in the
+// Accept-Encoding header of the request.
+func acceptedEncodings(r *http.Request) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			q := 1.0
+			if v, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				var err error
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			accepted[strings.ToLower(strings.TrimSpace(name))] = q
+		}
+	}
+	return accepted
+}
+
+// negotiateEncoding returns the index in contentEncodings of the encoding
+// preferred by the client, or -1 when it accepts none.
+func negotiateEncoding(r *http.Request) int {
+	accepted := acceptedEncodings(r)
+	best, bestQ := -1, 0.0
+	for i, enc := range contentEncodings {
+		q, exists := accepted[enc.name]
+		if !exists {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	return best
+}
+
+// isCompressedType reports whether content of the type is compressed
+// already, so that compressing it again would waste time.
+func isCompressedType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml",
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "font/woff"):
+		return true
+	}
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+		"application/x-brotli", "application/x-7z-compressed", "application/pdf",
+		"application/msgpack", "application/vnd.msgpack", "application/x-msgpack":
+		return true
+	}
+	return false
+}
+
+// compressResponseWriter buffers the start of the body until it knows
+// whether to compress the response: bodies under minCompressSize and content
+// that is compressed already are written as they are. Flushing decides right
+// away, so that streamed responses aren't held back.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	encoding int
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	compressor  compressionWriter
+}
+
+func (cw *compressResponseWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+
+	// Informational responses go out right away
+	if code >= 100 && code < 200 {
+		cw.wroteHeader = false
+		cw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < minCompressSize {
+			return len(p), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if cw.compressor != nil {
+		return cw.compressor.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// decide writes the header, compressing the body if it's worth it, and the
+// buffered start of the body. Bodies that aren't worth it because of their
+// size aren't compressed.
+func (cw *compressResponseWriter) decide(worthIt bool) error {
+	cw.decided = true
+	h := cw.Header()
+
+	compress := worthIt && len(cw.buf) > 0 &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		cw.r.Method != http.MethodHead &&
+		h.Get("Content-Encoding") == "" &&
+		!isCompressedType(h.Get("Content-Type"))
+
+	if compress {
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(cw.buf))
+		}
+		enc := contentEncodings[cw.encoding]
+		h.Set("Content-Encoding", enc.name)
+		h.Del("Content-Length")
+		// Strong validators belong to the uncompressed representation
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		cw.compressor = enc.pool.Get().(compressionWriter)
+		cw.compressor.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.compressor != nil {
+		_, err = cw.compressor.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressResponseWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		if err := cw.decide(true); err != nil {
+			requestLogger(cw.r).Error("Failed to write response", "error", err)
+			return
+		}
+	}
+	if cw.compressor != nil {
+		if err := cw.compressor.Flush(); err != nil {
+			requestLogger(cw.r).Error("Failed to flush compressed response", "error", err)
+			return
+		}
+	}
+	if err := http.NewResponseController(cw.ResponseWriter).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		requestLogger(cw.r).Error("Failed to flush response", "error", err)
+	}
+}
+
+// Hijack lets websockets and similar protocols take over the connection.
+func (cw *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close writes what's still buffered and finishes the compressed stream.
+func (cw *compressResponseWriter) close() error {
+	if !cw.wroteHeader {
+		// Nothing was written, let the server send its default response
+		return nil
+	}
+	// The body is complete, it's smaller than minCompressSize when it's
+	// still buffered
+	if !cw.decided {
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.compressor == nil {
+		return nil
+	}
+
+	err := cw.compressor.Close()
+	cw.compressor.Reset(nil)
+	contentEncodings[cw.encoding].pool.Put(cw.compressor)
+	cw.compressor = nil
+	return err
+}
+
+// compressionMiddleware compresses responses with the encoding the client
+// prefers among zstd, br and gzip.
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r)
+		if encoding < 0 || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w, r: r, encoding: encoding}
+		defer func() {
+			if err := cw.close(); err != nil {
+				requestLogger(r).Error("Failed to finish compressed response", "error", err)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// precompressedFileServer serves the files of the directory like
+// http.FileServer, but serves the .br or .gz sibling of a file instead when
+// it exists and the client accepts the encoding.
+func precompressedFileServer(dir string) http.Handler {
+	fileServer := http.FileServer(http.Dir(dir))
+	siblings := []struct{ encoding, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		name := path.Clean("/" + r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		accepted := acceptedEncodings(r)
+		for _, sibling := range siblings {
+			q, exists := accepted[sibling.encoding]
+			if !exists {
+				q = accepted["*"]
+			}
+			if q <= 0 {
+				continue
+			}
+
+			f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name+sibling.ext)))
+			if err != nil {
+				continue
+			}
+			info, err := f.Stat()
+			if err != nil || info.IsDir() {
+				f.Close()
+				continue
+			}
+
+			contentType := mime.TypeByExtension(path.Ext(name))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Encoding", sibling.encoding)
+			http.ServeContent(w, r, name, info.ModTime(), f)
+			f.Close()
+			return
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -1,8 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"sigs.k8s.io/yaml"
 )
@@ -10,20 +23,828 @@ import (
 type config struct {
 	Port    int      `json:"port"`
 	Modules []string `json:"modules"`
+	// ReloadInterval is how often the file is checked for changes, which
+	// are reloaded. Zero disables the checks, SIGHUP still reloads.
+	ReloadInterval duration `json:"reload_interval"`
+	// DatabaseURL is the connection string of the database, also read from
+	// the DATABASE_URL environmental variable.
+	DatabaseURL string       `json:"database_url" secret:"true"`
+	Server      serverConfig `json:"server"`
+	// TrustedProxies are the addresses or ranges of the proxies, like nginx,
+	// whose X-Client-IP header is trusted.
+	TrustedProxies  []string              `json:"trusted_proxies"`
+	Auth            authConfig            `json:"auth"`
+	Lockout         lockoutConfig         `json:"lockout"`
+	RateLimit       rateLimitConfig       `json:"rate_limit"`
+	Session         sessionConfig         `json:"session"`
+	JWT             jwtConfig             `json:"jwt"`
+	Roles           rolesConfig           `json:"roles"`
+	OIDC            oidcConfig            `json:"oidc"`
+	SecurityHeaders securityHeadersConfig `json:"security_headers"`
+	CORS            corsConfig            `json:"cors"`
+	Log             logConfig             `json:"log"`
+	AccessLog       accessLogConfig       `json:"access_log"`
+	Metrics         metricsConfig         `json:"metrics"`
+	Tracing         tracingConfig         `json:"tracing"`
+	Debug           debugConfig           `json:"debug"`
+	Health          healthConfig          `json:"health"`
+	Shutdown        shutdownConfig        `json:"shutdown"`
+
+	// file is the path of the file the configuration was loaded from, empty
+	// when there was none.
+	file string
 }
 
-func loadConfig(filename string) (config, error) {
-	var cfg config
+type serverConfig struct {
+	// ReadTimeout bounds reading a request, body included, and
+	// ReadHeaderTimeout reading its headers. WriteTimeout bounds the time
+	// from the end of the headers to the end of the response. Zero disables
+	// them.
+	ReadTimeout       duration `json:"read_timeout"`
+	ReadHeaderTimeout duration `json:"read_header_timeout"`
+	WriteTimeout      duration `json:"write_timeout"`
+	// IdleTimeout is how long a kept-alive connection waits for the next
+	// request.
+	IdleTimeout    duration `json:"idle_timeout"`
+	MaxHeaderBytes int      `json:"max_header_bytes"`
+	// KeepAlives reuses connections for further requests, they're closed
+	// after every response otherwise.
+	KeepAlives bool `json:"keep_alives"`
+	// Routes overrides the timeouts of routes, by the pattern they're
+	// registered with, e.g. "GET /api/v1/posts" for long exports.
+	Routes map[string]routeTimeoutConfig `json:"routes"`
+}
 
-	data, err := os.ReadFile(filepath.Clean(filename))
+type routeTimeoutConfig struct {
+	// Timeouts left out are those of the server, zero disables them.
+	ReadTimeout  *duration `json:"read_timeout"`
+	WriteTimeout *duration `json:"write_timeout"`
+}
+
+type authConfig struct {
+	// Username and Password are the credentials of the admin user, also
+	// read from the AUTH_USERNAME and AUTH_PASSWORD environmental variables.
+	Username string `json:"username"`
+	Password string `json:"password" secret:"true"`
+	// HtpasswdFile replaces the Username and Password credentials with the
+	// users of an htpasswd file when set, which is checked for changes
+	// every ReloadInterval. Zero disables reloading.
+	HtpasswdFile   string   `json:"htpasswd_file"`
+	ReloadInterval duration `json:"reload_interval"`
+}
+
+type lockoutConfig struct {
+	// FreeAttempts is the number of failures allowed before delays apply.
+	FreeAttempts int `json:"free_attempts"`
+	// BaseDelay is the first delay, doubled on each further failure.
+	BaseDelay duration `json:"base_delay"`
+	// LockoutDuration caps the delay.
+	LockoutDuration duration `json:"lockout_duration"`
+	// Window is how long failures are remembered.
+	Window duration `json:"window"`
+}
+
+type rateLimitConfig struct {
+	Default rateLimit `json:"default"`
+	// Routes overrides the default limit for route patterns, e.g.
+	// "POST /api/v1/posts".
+	Routes map[string]rateLimit `json:"routes"`
+	// PreAuth limits the requests by client address before they are
+	// authenticated, on the routes that are limited by identity.
+	PreAuth rateLimit `json:"pre_auth"`
+}
+
+type rateLimit struct {
+	Requests int      `json:"requests"`
+	Period   duration `json:"period"`
+	Burst    int      `json:"burst"`
+	// By is either "ip" or "identity" (the user or API key, falling back
+	// to the client address for anonymous requests).
+	By string `json:"by"`
+}
+
+type sessionConfig struct {
+	IdleTimeout     duration `json:"idle_timeout"`
+	AbsoluteTimeout duration `json:"absolute_timeout"`
+}
+
+type jwtConfig struct {
+	Issuer          string         `json:"issuer"`
+	Audience        string         `json:"audience"`
+	AccessTokenTTL  duration       `json:"access_token_ttl"`
+	RefreshTokenTTL duration       `json:"refresh_token_ttl"`
+	SigningKey      string         `json:"signing_key"`
+	Keys            []jwtKeyConfig `json:"keys"`
+}
+
+type jwtKeyConfig struct {
+	ID             string `json:"id"`
+	Algorithm      string `json:"algorithm"`
+	SecretFile     string `json:"secret_file"`
+	PrivateKeyFile string `json:"private_key_file"`
+}
+
+type rolesConfig struct {
+	// Default is the role of users that aren't listed in Users.
+	Default string `json:"default"`
+	// Users maps usernames to roles.
+	Users map[string]string `json:"users"`
+}
+
+type oidcConfig struct {
+	Issuer           string   `json:"issuer"`
+	ClientID         string   `json:"client_id"`
+	ClientSecretFile string   `json:"client_secret_file"`
+	RedirectURL      string   `json:"redirect_url"`
+	Scopes           []string `json:"scopes"`
+	UsernameClaim    string   `json:"username_claim"`
+	RolesClaim       string   `json:"roles_claim"`
+	// RoleMapping maps values of the roles claim to roles.
+	RoleMapping map[string]string `json:"role_mapping"`
+}
+
+type securityHeadersConfig struct {
+	// ContentSecurityPolicy may contain {nonce}, replaced with a nonce
+	// that changes with every request.
+	ContentSecurityPolicy string `json:"content_security_policy"`
+	CSPReportOnly         bool   `json:"csp_report_only"`
+	// FrameAncestors is added to the policy as the frame-ancestors
+	// directive.
+	FrameAncestors string `json:"frame_ancestors"`
+	// ReportURI is where browsers report violations of the policy: the
+	// report handler at /csp-report, or an absolute URL.
+	ReportURI             string   `json:"report_uri"`
+	HSTSMaxAge            duration `json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains"`
+	HSTSPreload           bool     `json:"hsts_preload"`
+	ReferrerPolicy        string   `json:"referrer_policy"`
+	PermissionsPolicy     string   `json:"permissions_policy"`
+}
+
+type corsConfig struct {
+	// AllowedOrigins may contain wildcards, e.g. "https://*.example.com".
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how long browsers may cache the result of a preflight.
+	MaxAge duration `json:"max_age"`
+}
+
+type logConfig struct {
+	// Format is either "text" or "json".
+	Format string `json:"format"`
+	// Level is the minimum level logged: debug, info, warn or error.
+	Level string `json:"level"`
+}
+
+type accessLogConfig struct {
+	// File is where the access log is written, no access log is written
+	// when it's empty.
+	File string `json:"file"`
+	// Format is "common", "combined" or a text/template using the fields
+	// of accessLogEntry, e.g. `{{.Host}} "{{.Request}}" {{.Status}} {{.Latency}}`.
+	Format string `json:"format"`
+	// The file is rotated when it grows larger than MaxSizeMB megabytes or
+	// older than MaxAge, zero disables either.
+	MaxSizeMB int      `json:"max_size_mb"`
+	MaxAge    duration `json:"max_age"`
+	// MaxBackups is the number of rotated files kept, zero keeps them all.
+	MaxBackups int  `json:"max_backups"`
+	Compress   bool `json:"compress"`
+}
+
+type metricsConfig struct {
+	// Listen is the address of a separate listener serving /metrics, e.g.
+	// "127.0.0.1:9090". The main server serves it when it's empty.
+	Listen string `json:"listen"`
+}
+
+type tracingConfig struct {
+	// Exporter is either "otlp" (OTLP over HTTP) or "stdout".
+	Exporter string `json:"exporter"`
+	// Endpoint is the URL of the OTLP collector, e.g.
+	// "http://localhost:4318/v1/traces". The OTEL_EXPORTER_OTLP_* variables
+	// apply when it's empty.
+	Endpoint    string `json:"endpoint"`
+	ServiceName string `json:"service_name"`
+	// SampleRatio is the share of traces recorded, unless the caller decided
+	// already.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+type debugConfig struct {
+	// Listen is the loopback address of the listener serving the
+	// diagnostics endpoints. The main server serves them to admins when
+	// it's empty.
+	Listen    string          `json:"listen"`
+	Profiling profilingConfig `json:"profiling"`
+}
+
+type profilingConfig struct {
+	// Dir is where profiles are written, no profiles are written when it's
+	// empty.
+	Dir string `json:"dir"`
+	// Every Interval, a CPU profile is taken for CPUDuration, followed by a
+	// heap profile.
+	Interval    duration `json:"interval"`
+	CPUDuration duration `json:"cpu_duration"`
+	// MaxFiles is the number of profiles of each kind kept, zero keeps
+	// them all.
+	MaxFiles int `json:"max_files"`
+}
+
+type healthConfig struct {
+	// CacheTTL is how long the result of a check is reused by further
+	// probes.
+	CacheTTL duration `json:"cache_ttl"`
+	// Timeout bounds every check, so that a hanging dependency fails the
+	// probe instead of blocking it.
+	Timeout duration `json:"timeout"`
+	// DiskPaths are checked for at least MinFreeDiskMB megabytes of free
+	// space.
+	DiskPaths     []string `json:"disk_paths"`
+	MinFreeDiskMB int      `json:"min_free_disk_mb"`
+	// Dependencies are services that must answer without a server error
+	// for the server to be ready.
+	Dependencies []healthDependencyConfig `json:"dependencies"`
+}
+
+type healthDependencyConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type shutdownConfig struct {
+	// PreStopDelay is how long the server keeps serving after readiness
+	// started failing, before it drains connections.
+	PreStopDelay duration `json:"pre_stop_delay"`
+	// Timeout is how long requests are given to finish once draining
+	// started, after which their connections are closed.
+	Timeout duration `json:"timeout"`
+	// HookTimeout bounds each of the hooks releasing resources afterwards,
+	// like flushing traces.
+	HookTimeout duration `json:"hook_timeout"`
+}
+
+// duration is a time.Duration that is written in the configuration file
+// as a string, e.g. "30m" or "12h".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %v", err)
+	}
+
+	v, err := time.ParseDuration(s)
 	if err != nil {
-		return config{}, err
+		return err
 	}
 
-	err = yaml.Unmarshal(data, &cfg)
+	*d = duration(v)
+	return nil
+}
+
+// defaultConfig returns the configuration used for everything the file, the
+// environment and the flags leave out.
+func defaultConfig() config {
+	return config{
+		Port:           3000,
+		ReloadInterval: duration(5 * time.Second),
+		Server: serverConfig{
+			ReadTimeout:       duration(5 * time.Second),
+			ReadHeaderTimeout: duration(2 * time.Second),
+			WriteTimeout:      duration(10 * time.Second),
+			IdleTimeout:       duration(30 * time.Second),
+			MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+			KeepAlives:        true,
+		},
+		Auth: authConfig{
+			ReloadInterval: duration(5 * time.Second),
+		},
+		Lockout: lockoutConfig{
+			FreeAttempts:    5,
+			BaseDelay:       duration(time.Second),
+			LockoutDuration: duration(15 * time.Minute),
+			Window:          duration(time.Hour),
+		},
+		RateLimit: rateLimitConfig{
+			Default: rateLimit{Requests: 60, Period: duration(time.Minute), Burst: 30, By: "ip"},
+			PreAuth: rateLimit{Requests: 60, Period: duration(time.Minute), Burst: 30, By: "ip"},
+		},
+		Session: sessionConfig{
+			IdleTimeout:     duration(30 * time.Minute),
+			AbsoluteTimeout: duration(12 * time.Hour),
+		},
+		JWT: jwtConfig{
+			Issuer:          "http-server",
+			Audience:        "http-server",
+			AccessTokenTTL:  duration(15 * time.Minute),
+			RefreshTokenTTL: duration(30 * 24 * time.Hour),
+		},
+		Roles: rolesConfig{
+			Default: roleViewer,
+		},
+		OIDC: oidcConfig{
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			RolesClaim:    "groups",
+		},
+		SecurityHeaders: securityHeadersConfig{
+			ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'self'; form-action 'self'",
+			FrameAncestors:        "'none'",
+			ReportURI:             cspReportPath,
+			HSTSMaxAge:            duration(365 * 24 * time.Hour),
+			HSTSIncludeSubdomains: true,
+			ReferrerPolicy:        "strict-origin-when-cross-origin",
+			PermissionsPolicy:     "camera=(), microphone=(), geolocation=(), payment=()",
+		},
+		CORS: corsConfig{
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-API-Key"},
+			ExposedHeaders: []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"},
+			MaxAge:         duration(10 * time.Minute),
+		},
+		Log: logConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		AccessLog: accessLogConfig{
+			Format:     "combined",
+			MaxSizeMB:  100,
+			MaxBackups: 7,
+			Compress:   true,
+		},
+		Tracing: tracingConfig{
+			Exporter:    "otlp",
+			ServiceName: "http-server",
+			SampleRatio: 1,
+		},
+		Health: healthConfig{
+			CacheTTL:      duration(5 * time.Second),
+			Timeout:       duration(2 * time.Second),
+			MinFreeDiskMB: 100,
+		},
+		Shutdown: shutdownConfig{
+			PreStopDelay: duration(5 * time.Second),
+			Timeout:      duration(30 * time.Second),
+			HookTimeout:  duration(5 * time.Second),
+		},
+		Debug: debugConfig{
+			Listen: "127.0.0.1:6060",
+			Profiling: profilingConfig{
+				Interval:    duration(10 * time.Minute),
+				CPUDuration: duration(30 * time.Second),
+				MaxFiles:    24,
+			},
+		},
+	}
+}
+
+// envPrefix starts the names of the environmental variables setting
+// configuration fields, e.g. HTTP_SERVER_PORT or HTTP_SERVER_LOG_LEVEL.
+const envPrefix = "HTTP_SERVER_"
+
+// legacyEnv maps fields to the environmental variables that set them before
+// they were part of the configuration.
+var legacyEnv = map[string]string{
+	"database_url":  "DATABASE_URL",
+	"auth.username": "AUTH_USERNAME",
+	"auth.password": "AUTH_PASSWORD",
+}
+
+// configField is a field of the configuration that can be set from the
+// environment or the command line. Maps and lists of sections can only be
+// set in the file.
+type configField struct {
+	path   []string
+	value  reflect.Value
+	secret bool
+}
+
+func (f configField) name() string {
+	return strings.Join(f.path, ".")
+}
+
+func (f configField) envName() string {
+	return envPrefix + strings.ToUpper(strings.Join(f.path, "_"))
+}
+
+func (f configField) flagName() string {
+	return strings.ReplaceAll(f.name(), "_", "-")
+}
+
+// configFields lists the fields of the section v, named after their JSON
+// names.
+func configFields(v reflect.Value, path []string) []configField {
+	var fields []configField
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fieldPath := append(slices.Clone(path), name)
+
+		value := v.Field(i)
+		switch {
+		case value.Kind() == reflect.Struct:
+			fields = append(fields, configFields(value, fieldPath)...)
+		case value.Kind() == reflect.Map, value.Kind() == reflect.Slice && value.Type().Elem().Kind() != reflect.String:
+			continue
+		default:
+			fields = append(fields, configField{path: fieldPath, value: value, secret: field.Tag.Get("secret") == "true"})
+		}
+	}
+	return fields
+}
+
+// set parses s into the field. Lists are comma-separated.
+func (f configField) set(s string) error {
+	v := f.value
+	if v.Type() == reflect.TypeFor[duration]() {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't an integer", s)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", s)
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// lookupEnvOrFile returns the value of the environmental variable, or the
+// content of the file named by the variable with the _FILE suffix, as used
+// for Docker secrets. Empty variables count as unset, like those passed
+// through by Compose when they aren't set on the host.
+func lookupEnvOrFile(lookupEnv func(string) (string, bool), name string) (string, bool, error) {
+	if value, _ := lookupEnv(name); value != "" {
+		return value, true, nil
+	}
+	file, _ := lookupEnv(name + "_FILE")
+	if file == "" {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(filepath.Clean(file))
 	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// loadConfig merges, from lowest to highest precedence, the defaults, the
+// configuration file, the environment and the command-line flags, and
+// validates the result. Every problem found is reported in the returned
+// error, which wraps flag.ErrHelp when the usage was asked for.
+//
+// The file is config.yaml unless --config or HTTP_SERVER_CONFIG names
+// another one. Secret fields can't be set with flags, which other users of
+// the host can see.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (config, error) {
+	cfg := defaultConfig()
+	fields := configFields(reflect.ValueOf(&cfg).Elem(), nil)
+
+	type flagValue struct {
+		field configField
+		value string
+	}
+	var flagValues []flagValue
+
+	flags := flag.NewFlagSet("http-server", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path of the configuration file (default config.yaml, env HTTP_SERVER_CONFIG)")
+	for _, field := range fields {
+		if field.secret {
+			continue
+		}
+		usage := fmt.Sprintf("sets %s (env %s)", field.name(), field.envName())
+		record := func(s string) error {
+			flagValues = append(flagValues, flagValue{field, s})
+			return nil
+		}
+		if field.value.Kind() == reflect.Bool {
+			flags.BoolFunc(field.flagName(), usage, record)
+		} else {
+			flags.Func(field.flagName(), usage, record)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return config{}, err
+	}
+	if flags.NArg() > 0 {
+		return config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	// A missing file is only an error when it was asked for
+	filename, explicit := *configFile, *configFile != ""
+	if !explicit {
+		filename, _ = lookupEnv(envPrefix + "CONFIG")
+		explicit = filename != ""
+	}
+	if !explicit {
+		filename = "config.yaml"
+	}
+	data, err := os.ReadFile(filepath.Clean(filename))
+	if err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
 		return config{}, err
 	}
+	if err == nil {
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return config{}, fmt.Errorf("%s: %v", filename, err)
+		}
+		cfg.file = filename
+	}
+
+	var errs []error
+	for _, field := range fields {
+		name := field.envName()
+		value, ok, err := lookupEnvOrFile(lookupEnv, name)
+		if !ok && err == nil && legacyEnv[field.name()] != "" {
+			name = legacyEnv[field.name()]
+			value, ok, err = lookupEnvOrFile(lookupEnv, name)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := field.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	for _, fv := range flagValues {
+		if err := fv.field.set(fv.value); err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %v", fv.field.flagName(), err))
+		}
+	}
+
+	errs = append(errs, cfg.validate()...)
+	return cfg, errors.Join(errs...)
+}
+
+// configErrors returns the problems reported by loadConfig one by one.
+func configErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// knownModules are the modules that can be listed in the configuration.
+var knownModules = []string{"webui", "auth", "database", "jwt", "apikeys", "oidc", "ratelimit", "cors", "compression", "metrics", "tracing", "debug"}
+
+// knownRoutes are the patterns registered with app.handle, whose timeouts
+// and rate limits can be overridden in server.routes and rate_limit.routes.
+var knownRoutes = []string{
+	"POST /login", "GET /login/oidc", "GET /login/oidc/callback",
+	"GET /api/v1/posts", "GET /api/v1/posts/{id}", "POST /api/v1/posts", "PUT /api/v1/posts/{id}", "DELETE /api/v1/posts/{id}",
+	"POST /api/v1/lockouts/unlock", "POST /api/v1/tokens",
+	"POST /api/v1/keys", "GET /api/v1/keys", "DELETE /api/v1/keys/{id}",
+	"GET /metrics", "/debug/", "POST /csp-report",
+}
+
+// validate checks the whole configuration and returns every problem found.
+func (cfg config) validate() []error {
+	var errs []error
+	addErr := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	enabled := map[string]bool{}
+	for _, module := range cfg.Modules {
+		if !slices.Contains(knownModules, module) {
+			addErr("modules: unknown module %q", module)
+		}
+		enabled[module] = true
+	}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		addErr("port: %d isn't between 1 and 65535", cfg.Port)
+	}
+
+	// A misspelled pattern would silently get the defaults
+	checkRoute := func(section, pattern string) {
+		if !slices.Contains(knownRoutes, pattern) {
+			addErr("%s: unknown route %q", section, pattern)
+		}
+	}
+
+	for _, timeout := range []struct {
+		name  string
+		value duration
+	}{
+		{"read_timeout", cfg.Server.ReadTimeout},
+		{"read_header_timeout", cfg.Server.ReadHeaderTimeout},
+		{"write_timeout", cfg.Server.WriteTimeout},
+		{"idle_timeout", cfg.Server.IdleTimeout},
+	} {
+		if timeout.value < 0 {
+			addErr("server.%s: must not be negative", timeout.name)
+		}
+	}
+	if cfg.Server.MaxHeaderBytes < 0 {
+		addErr("server.max_header_bytes: must not be negative")
+	}
+	for pattern, route := range cfg.Server.Routes {
+		checkRoute("server.routes", pattern)
+		if (route.ReadTimeout != nil && *route.ReadTimeout < 0) || (route.WriteTimeout != nil && *route.WriteTimeout < 0) {
+			addErr("server.routes[%q]: timeouts must not be negative", pattern)
+		}
+	}
+
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		addErr("trusted_proxies: %v", err)
+	}
+
+	if enabled["database"] && cfg.DatabaseURL == "" {
+		addErr("database_url: required by the database module (or DATABASE_URL)")
+	}
+
+	for _, module := range []string{"jwt", "apikeys", "oidc"} {
+		if enabled[module] && !enabled["auth"] {
+			addErr("modules: the %s module requires the auth module", module)
+		}
+	}
+	if enabled["oidc"] && !enabled["webui"] {
+		addErr("modules: the oidc module requires the webui module")
+	}
+	if enabled["metrics"] && cfg.Metrics.Listen == "" && !enabled["auth"] {
+		addErr("modules: the metrics module requires the auth module unless metrics.listen is set")
+	}
+	if enabled["debug"] && cfg.Debug.Listen == "" && !enabled["auth"] {
+		addErr("modules: the debug module requires the auth module unless debug.listen is set")
+	}
+
+	if enabled["auth"] {
+		if cfg.Auth.HtpasswdFile == "" {
+			if cfg.Auth.Username == "" {
+				addErr("auth.username: required unless auth.htpasswd_file is set (or AUTH_USERNAME)")
+			}
+			if cfg.Auth.Password == "" {
+				addErr("auth.password: required unless auth.htpasswd_file is set (or AUTH_PASSWORD)")
+			}
+		}
+		if err := cfg.Roles.validate(); err != nil {
+			addErr("roles: %v", err)
+		}
+		if cfg.Session.IdleTimeout <= 0 || cfg.Session.AbsoluteTimeout <= 0 {
+			addErr("session: timeouts must be positive")
+		}
+		if cfg.Lockout.FreeAttempts < 0 {
+			addErr("lockout.free_attempts: must not be negative")
+		}
+		if cfg.Lockout.BaseDelay <= 0 || cfg.Lockout.LockoutDuration < cfg.Lockout.BaseDelay {
+			addErr("lockout: base_delay must be positive and at most lockout_duration")
+		}
+		if cfg.Lockout.Window <= 0 {
+			addErr("lockout.window: must be positive")
+		}
+	}
+
+	if enabled["jwt"] {
+		if err := cfg.JWT.validate(); err != nil {
+			addErr("jwt: %v", err)
+		}
+	}
+
+	if enabled["oidc"] {
+		if u, err := url.Parse(cfg.OIDC.Issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			addErr("oidc.issuer: invalid URL %q", cfg.OIDC.Issuer)
+		}
+		if cfg.OIDC.ClientID == "" {
+			addErr("oidc.client_id: required")
+		}
+		if u, err := url.Parse(cfg.OIDC.RedirectURL); err != nil || !u.IsAbs() {
+			addErr("oidc.redirect_url: invalid URL %q (must be absolute)", cfg.OIDC.RedirectURL)
+		}
+		for group, name := range cfg.OIDC.RoleMapping {
+			if _, exists := roles[name]; !exists {
+				addErr("oidc.role_mapping: unknown role %q for %q", name, group)
+			}
+		}
+	}
+
+	if enabled["ratelimit"] {
+		if _, err := cfg.RateLimit.normalize(); err != nil {
+			addErr("rate_limit: %v", err)
+		}
+		for pattern := range cfg.RateLimit.Routes {
+			checkRoute("rate_limit.routes", pattern)
+		}
+	}
+
+	if enabled["cors"] {
+		if err := cfg.CORS.validate(); err != nil {
+			addErr("cors: %v", err)
+		}
+	}
+
+	// Reports sent to a local path other than the report handler would go
+	// nowhere
+	if uri := cfg.SecurityHeaders.ReportURI; uri != "" && uri != cspReportPath {
+		if u, err := url.Parse(uri); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			addErr("security_headers.report_uri: invalid URL %q (must be %s or an absolute URL)", uri, cspReportPath)
+		}
+	}
+
+	if err := cfg.Log.validate(); err != nil {
+		addErr("log: %v", err)
+	}
+
+	if cfg.AccessLog.File != "" {
+		if _, err := parseAccessLogFormat(cfg.AccessLog.Format); err != nil {
+			addErr("access_log.format: %v", err)
+		}
+	}
+
+	if enabled["metrics"] && cfg.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Metrics.Listen); err != nil {
+			addErr("metrics.listen: %v", err)
+		}
+	}
+
+	if enabled["tracing"] {
+		if err := cfg.Tracing.validate(); err != nil {
+			addErr("tracing: %v", err)
+		}
+	}
+
+	if enabled["debug"] {
+		if cfg.Debug.Listen != "" && !isLoopbackAddr(cfg.Debug.Listen) {
+			addErr("debug.listen: %q isn't a loopback address", cfg.Debug.Listen)
+		}
+		if cfg.Debug.Profiling.Dir != "" {
+			if err := cfg.Debug.Profiling.validate(); err != nil {
+				addErr("debug.profiling: %v", err)
+			}
+		}
+	}
+
+	if cfg.Health.Timeout <= 0 {
+		addErr("health.timeout: must be positive")
+	}
+	for i, dep := range cfg.Health.Dependencies {
+		if dep.Name == "" {
+			addErr("health.dependencies[%d]: missing name", i)
+		}
+		if u, err := url.Parse(dep.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			addErr("health.dependencies[%d]: invalid URL %q", i, dep.URL)
+		}
+	}
+
+	if cfg.ReloadInterval < 0 {
+		addErr("reload_interval: must not be negative")
+	}
+	if cfg.Auth.ReloadInterval < 0 {
+		addErr("auth.reload_interval: must not be negative")
+	}
+
+	if cfg.Shutdown.PreStopDelay < 0 {
+		addErr("shutdown.pre_stop_delay: must not be negative")
+	}
+	if cfg.Shutdown.Timeout <= 0 {
+		addErr("shutdown.timeout: must be positive")
+	}
+	if cfg.Shutdown.HookTimeout <= 0 {
+		addErr("shutdown.hook_timeout: must be positive")
+	}
 
-	return cfg, nil
+	return errs
 }
@@ -1,7 +1,8 @@
 CREATE TABLE posts (
     id SERIAL PRIMARY KEY,
     author VARCHAR(100),
-    message TEXT
+    message TEXT,
+    owner TEXT NOT NULL DEFAULT ''
 );
 
 INSERT INTO posts (author, message) VALUES
@@ -10,3 +11,43 @@ INSERT INTO posts (author, message) VALUES
 ('Geralt of Rivia', 'Hmmm... Wind''s howling...'),
 ('Obi-Wan Kenobi', 'May the force be with you ⚡'),
 ('R2-D2', 'May the 4th bla-bla bee-boop');
+
+CREATE TABLE sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    username TEXT NOT NULL,
+    display_name VARCHAR(100) NOT NULL DEFAULT '',
+    role VARCHAR(20) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL,
+    last_seen TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE refresh_tokens (
+    hash CHAR(64) PRIMARY KEY,
+    subject TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE api_keys (
+    id CHAR(16) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE TABLE auth_failures (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    pending INTEGER NOT NULL DEFAULT 0,
+    last_failure TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ
+);
+
+CREATE UNLOGGED TABLE rate_limits (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    allowed BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
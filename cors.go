@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// allowsOrigin reports whether the origin matches one of the allowed origins.
+// Allowed origins may contain wildcards, e.g. "https://*.example.com", and
+// "*" allows any origin.
+func (cfg corsConfig) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range cfg.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if matched, err := path.Match(strings.ToLower(allowed), strings.ToLower(origin)); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg corsConfig) validate() error {
+	for _, allowed := range cfg.AllowedOrigins {
+		if allowed == "*" {
+			// Origins are echoed, so every site could make credentialed
+			// requests, and CSRF protection trusts the allowed origins
+			if cfg.AllowCredentials {
+				return errors.New(`allowed origin "*" can't be combined with allow_credentials`)
+			}
+			continue
+		}
+		if _, err := path.Match(allowed, ""); err != nil {
+			return fmt.Errorf("invalid origin %q: %v", allowed, err)
+		}
+		scheme, host, ok := strings.Cut(allowed, "://")
+		if !ok || scheme == "" || host == "" || strings.Contains(host, "/") {
+			return fmt.Errorf("invalid origin %q (must be like https://example.com)", allowed)
+		}
+	}
+	if cfg.MaxAge < 0 {
+		return errors.New("max_age must not be negative")
+	}
+	return nil
+}
+
+func (cfg corsConfig) allowsMethod(method string) bool {
+	for _, allowed := range cfg.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware lets the allowed origins call the API from browsers. It
+// answers preflight requests for every route registered with the mux, and
+// adds the CORS headers to the responses of actual requests. The origin is
+// always echoed rather than "*", so that credentials can be allowed. The
+// configuration is read for every request, so that it can be reloaded.
+func corsMiddleware(currentConfig func() corsConfig, mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && requestMethod != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+			// Let the mux answer preflights for routes that don't exist
+			// with the requested method
+			probe := r.Clone(r.Context())
+			probe.Method = requestMethod
+			if _, pattern := mux.Handler(probe); pattern == "" || pattern == "/" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !cfg.allowsOrigin(origin) || !cfg.allowsMethod(requestMethod) {
+				writeProblem(w, r, http.StatusForbidden, "Cross-origin request not allowed")
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+			if len(cfg.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+			}
+			if cfg.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if cfg.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(cfg.MaxAge).Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if cfg.allowsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if cfg.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(cfg.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
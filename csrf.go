@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// csrfToken returns the CSRF token of the client, setting a new one in a
+// cookie if the client has none yet. Pages render it into forms and a meta
+// tag read by static/index.js.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		requestLogger(r).Error("Failed to generate CSRF token", "error", err)
+		return ""
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return token
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+func isFormSubmission(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data"
+}
+
+// csrfTrustedOrigin reports whether the CSRF protection lets requests from
+// the origin through: the CORS allowed origins, as currently configured.
+// Requests with the session cookie or a form are only let through from
+// origins allowed to send credentials, which never include "*". Other
+// requests are authenticated by a header the page of the origin had to set
+// itself.
+func (app *application) csrfTrustedOrigin(origin string, ambient bool) bool {
+	cors := app.currentConfig().CORS
+	if !app.liveModuleEnabled("cors") || (ambient && !cors.AllowCredentials) {
+		return false
+	}
+	return cors.allowsOrigin(origin)
+}
+
+// csrfMiddleware protects unsafe requests against cross-site request forgery.
+// Browsers announce where a request comes from in Sec-Fetch-Site or Origin,
+// cross-site requests are rejected. Requests authenticated by the session
+// cookie and form submissions must also echo the token from the CSRF cookie
+// in the X-CSRF-Token header or the csrf_token form field (double-submit).
+// Other API clients don't send cookies, so they aren't affected. Origins
+// for which trustedOrigin returns true, the CORS allowed origins, may send
+// cross-site requests. trustedOrigin is told whether the request carries
+// credentials the browser sends on its own, the session cookie or a form,
+// since requests with a Bearer token or an API key can't be forged.
+func csrfMiddleware(trustedOrigin func(origin string, ambient bool) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, err := r.Cookie(sessionCookieName)
+		hasSession := err == nil
+		ambient := hasSession || isFormSubmission(r)
+
+		origin := r.Header.Get("Origin")
+		trusted := origin != "" && trustedOrigin != nil && trustedOrigin(origin, ambient)
+
+		switch r.Header.Get("Sec-Fetch-Site") {
+		case "", "same-origin", "none":
+		default:
+			if !trusted {
+				writeProblem(w, r, http.StatusForbidden, "Cross-site request")
+				return
+			}
+		}
+
+		if origin != "" && !trusted {
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				writeProblem(w, r, http.StatusForbidden, "Cross-origin request")
+				return
+			}
+		}
+
+		if !ambient {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		if err != nil || cookie.Value == "" {
+			writeProblem(w, r, http.StatusForbidden, "Missing CSRF token")
+			return
+		}
+
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			token = r.PostFormValue(csrfFormField)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			writeProblem(w, r, http.StatusForbidden, "Invalid CSRF token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"slices"
+	"time"
+)
+
+// permDebug allows using the diagnostics endpoints when they're served by
+// the main server.
+const permDebug = "debug:access"
+
+// debugHandler serves pprof profiles, expvar variables and a dump of the
+// stacks of all goroutines under /debug/.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /debug/goroutines", goroutineDumpHandler)
+	mux.HandleFunc("/", notFoundHandler(mux))
+	return mux
+}
+
+func goroutineDumpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := runtimepprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		requestLogger(r).Error("Failed to dump goroutines", "error", err)
+	}
+}
+
+// isLoopbackAddr reports whether the listen address only accepts connections
+// from the same host.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// profiler writes CPU and heap profiles to a directory every interval,
+// keeping the latest ones.
+type profiler struct {
+	cfg profilingConfig
+}
+
+func (cfg profilingConfig) validate() error {
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("invalid interval %v", time.Duration(cfg.Interval))
+	}
+	if cfg.CPUDuration <= 0 || cfg.CPUDuration > cfg.Interval {
+		return fmt.Errorf("invalid CPU profile duration %v (must be positive and at most the interval)", time.Duration(cfg.CPUDuration))
+	}
+	return nil
+}
+
+func newProfiler(cfg profilingConfig) (*profiler, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Clean(cfg.Dir), 0o750); err != nil {
+		return nil, err
+	}
+	return &profiler{cfg: cfg}, nil
+}
+
+// run profiles until the context is canceled.
+func (p *profiler) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().UTC().Format("20060102T150405")
+		if err := p.writeCPUProfile(ctx, filepath.Join(p.cfg.Dir, "cpu-"+now+".pprof")); err != nil {
+			slog.Error("Failed to write CPU profile", "error", err)
+		}
+		if err := p.writeHeapProfile(filepath.Join(p.cfg.Dir, "heap-"+now+".pprof")); err != nil {
+			slog.Error("Failed to write heap profile", "error", err)
+		}
+		p.prune("cpu-*.pprof")
+		p.prune("heap-*.pprof")
+	}
+}
+
+func (p *profiler) writeCPUProfile(ctx context.Context, name string) error {
+	f, err := os.Create(filepath.Clean(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Fails when a profile is being taken through /debug/pprof/profile
+	if err := runtimepprof.StartCPUProfile(f); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(p.cfg.CPUDuration)):
+	}
+	runtimepprof.StopCPUProfile()
+
+	return f.Close()
+}
+
+func (p *profiler) writeHeapProfile(name string) error {
+	f, err := os.Create(filepath.Clean(name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Up to date statistics of the last garbage collection
+	runtime.GC()
+	if err := runtimepprof.Lookup("heap").WriteTo(f, 0); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// prune removes the oldest profiles matching the pattern beyond MaxFiles.
+func (p *profiler) prune(pattern string) {
+	if p.cfg.MaxFiles <= 0 {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(p.cfg.Dir, pattern))
+	if err != nil {
+		slog.Error("Failed to list profiles", "error", err)
+		return
+	}
+
+	// The names sort by the time of the profile
+	slices.Sort(files)
+	for len(files) > p.cfg.MaxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			slog.Error("Failed to remove profile", "file", files[0], "error", err)
+		}
+		files = files[1:]
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxRequestBodyBytes is the largest JSON request body accepted.
+const maxRequestBodyBytes = 1 << 20
+
+// Field length limits, matching the columns in config/init.sql.
+const (
+	maxAuthorLength  = 100
+	maxMessageLength = 10000
+	maxKeyNameLength = 100
+)
+
+// requestError is an invalid request. Its message is safe to send to the
+// client, Field is the path of the offending field, e.g. "author", if any.
+type requestError struct {
+	Status  int
+	Field   string
+	Message string
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+func fieldError(field, format string, args ...any) *requestError {
+	return &requestError{Status: http.StatusBadRequest, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// decodeJSON decodes the request body, a single JSON object, into v. Bodies
+// larger than maxRequestBodyBytes and unknown fields are rejected. Errors are
+// *requestError, describing the problem without echoing the decoder error.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		var syntaxError *json.SyntaxError
+		var typeError *json.UnmarshalTypeError
+		var maxBytesError *http.MaxBytesError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return &requestError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Request body contains malformed JSON at position %d", syntaxError.Offset)}
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return &requestError{Status: http.StatusBadRequest, Message: "Request body contains malformed JSON"}
+		case errors.As(err, &typeError):
+			if typeError.Field == "" {
+				return &requestError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Request body must be a JSON %s", jsonTypeName(typeError.Type))}
+			}
+			return fieldError(typeError.Field, "Field %s must be a %s", typeError.Field, jsonTypeName(typeError.Type))
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			// The decoder has no error type for unknown fields
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return fieldError(field, "Unknown field %s", field)
+		case errors.Is(err, io.EOF):
+			return &requestError{Status: http.StatusBadRequest, Message: "Request body must not be empty"}
+		case errors.As(err, &maxBytesError):
+			return &requestError{Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Request body must not be larger than %d bytes", maxBytesError.Limit)}
+		default:
+			requestLogger(r).Error("Failed to read request body", "error", err)
+			return &requestError{Status: http.StatusBadRequest, Message: "Failed to read request body"}
+		}
+	}
+
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return &requestError{Status: http.StatusBadRequest, Message: "Request body must contain a single JSON object"}
+	}
+
+	return nil
+}
+
+// jsonTypeName returns how the type is called in JSON.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// checkLength returns an error when the value is longer than max characters.
+func checkLength(field, value string, max int) error {
+	if utf8.RuneCountInString(value) > max {
+		return fieldError(field, "Field %s must be at most %d characters long", field, max)
+	}
+	return nil
+}
+
+// writeRequestError responds with the error returned by decodeJSON or a
+// validation.
+func writeRequestError(w http.ResponseWriter, r *http.Request, err error) {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		requestLogger(r).Error("Invalid request", "error", err)
+		writeProblem(w, r, http.StatusBadRequest, "")
+		return
+	}
+
+	p := problem{Status: reqErr.Status, Detail: reqErr.Message}
+	if reqErr.Field != "" {
+		p.Errors = []fieldProblem{{
+			Detail:  reqErr.Message,
+			Pointer: "#/" + strings.ReplaceAll(reqErr.Field, ".", "/"),
+		}}
+	}
+	writeProblemDetails(w, r, p)
+}
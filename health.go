@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthCheck is a named check of something the server depends on.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+
+	// The result is kept for the cache TTL of the registry, and concurrent
+	// probes wait for the same run
+	mu        sync.Mutex
+	err       error
+	latency   time.Duration
+	checkedAt time.Time
+}
+
+// healthRegistry runs a set of checks for a probe endpoint.
+type healthRegistry struct {
+	cacheTTL time.Duration
+	// timeout bounds every check, so that a hanging dependency fails the
+	// probe instead of blocking it.
+	timeout time.Duration
+	checks  []*healthCheck
+	// draining fails the probe from the start of the shutdown on,
+	// regardless of cached results.
+	draining atomic.Bool
+}
+
+func newHealthRegistry(cacheTTL, timeout time.Duration) *healthRegistry {
+	return &healthRegistry{cacheTTL: cacheTTL, timeout: timeout}
+}
+
+// startDraining fails the probe with a "shutdown" check from now on.
+func (h *healthRegistry) startDraining() {
+	h.draining.Store(true)
+}
+
+// add registers a check. Checks must be added before the server starts.
+func (h *healthRegistry) add(name string, check func(ctx context.Context) error) {
+	h.checks = append(h.checks, &healthCheck{name: name, check: check})
+}
+
+func (c *healthCheck) run(ctx context.Context, cacheTTL, timeout time.Duration) (time.Duration, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < cacheTTL {
+		return c.latency, c.checkedAt, c.err
+	}
+
+	// The result is shared, so it mustn't depend on the probe that ran it
+	// going away
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	start := time.Now()
+	c.err = c.check(ctx)
+	c.latency = time.Since(start)
+	c.checkedAt = start
+	if c.err != nil {
+		// Errors may tell about the database, hosts and paths, so they are
+		// logged rather than shown to probes
+		slog.Warn("Health check failed", "check", c.name, "error", c.err)
+	}
+	return c.latency, c.checkedAt, c.err
+}
+
+type checkResult struct {
+	Name      string     `json:"name"`
+	Status    string     `json:"status"`
+	LatencyMS *float64   `json:"latency_ms,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+type healthResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// ServeHTTP runs the checks, except those named in the exclude parameter, and
+// answers 200 when all pass and 503 otherwise. Latencies are only shown with
+// the verbose parameter. The probes are public, so errors are only logged.
+func (h *healthRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	verbose := query.Has("verbose")
+	var excluded []string
+	for _, value := range query["exclude"] {
+		excluded = append(excluded, strings.Split(value, ",")...)
+	}
+
+	var checks []*healthCheck
+	for _, c := range h.checks {
+		if !slices.Contains(excluded, c.name) {
+			checks = append(checks, c)
+		}
+	}
+
+	resp := healthResponse{Status: "ok", Checks: make([]checkResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			latency, checkedAt, err := c.run(r.Context(), h.cacheTTL, h.timeout)
+			result := checkResult{Name: c.name, Status: "ok"}
+			if err != nil {
+				result.Status = "failed"
+			}
+			if verbose {
+				ms := float64(latency) / float64(time.Millisecond)
+				result.LatencyMS = &ms
+				result.CheckedAt = &checkedAt
+			}
+			resp.Checks[i] = result
+		}()
+	}
+	wg.Wait()
+
+	if h.draining.Load() && !slices.Contains(excluded, "shutdown") {
+		result := checkResult{Name: "shutdown", Status: "failed"}
+		resp.Checks = append(resp.Checks, result)
+	}
+
+	status := http.StatusOK
+	for _, result := range resp.Checks {
+		if result.Status != "ok" {
+			resp.Status = "failed"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		requestLogger(r).Error("Failed to encode health checks", "error", err)
+	}
+}
+
+// healthChecks builds the registries of the liveness probe, which only fails
+// when the process can't serve requests, and of the readiness probe, which
+// also checks what the server depends on.
+func (app *application) healthChecks(cfg healthConfig) (liveness, readiness *healthRegistry) {
+	liveness = newHealthRegistry(0, time.Duration(cfg.Timeout))
+	liveness.add("ping", func(ctx context.Context) error { return nil })
+
+	readiness = newHealthRegistry(time.Duration(cfg.CacheTTL), time.Duration(cfg.Timeout))
+	if app.enabledModules["database"] {
+		readiness.add("database", func(ctx context.Context) error { return app.db.Ping(ctx) })
+		readiness.add("schema", app.checkSchema)
+	}
+	for _, path := range cfg.DiskPaths {
+		if _, err := diskFree(path); errors.Is(err, errors.ErrUnsupported) {
+			slog.Warn("Disk space checks aren't supported on this system", "path", path)
+			continue
+		}
+		readiness.add("disk:"+path, checkDiskSpace(path, cfg.MinFreeDiskMB))
+	}
+	client := &http.Client{}
+	for _, dep := range cfg.Dependencies {
+		readiness.add(dep.Name, checkDependency(client, dep.URL))
+	}
+
+	return liveness, readiness
+}
+
+// requiredTables returns the tables the enabled modules need, created by
+// config/init.sql.
+func (app *application) requiredTables() []string {
+	tables := []string{"posts"}
+	if app.enabledModules["auth"] {
+		tables = append(tables, "sessions", "auth_failures")
+	}
+	if app.enabledModules["jwt"] {
+		tables = append(tables, "refresh_tokens")
+	}
+	if app.enabledModules["apikeys"] {
+		tables = append(tables, "api_keys")
+	}
+	if app.enabledModules["ratelimit"] {
+		tables = append(tables, "rate_limits")
+	}
+	return tables
+}
+
+// checkSchema fails when tables of the enabled modules are missing from the
+// database.
+func (app *application) checkSchema(ctx context.Context) error {
+	rows, err := app.db.Query(ctx, "SELECT t FROM unnest($1::text[]) AS t WHERE to_regclass(t) IS NULL", app.requiredTables())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var missing []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return err
+		}
+		missing = append(missing, table)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing tables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkDiskSpace fails when the file system of the path has less than
+// minFreeMB megabytes available.
+func checkDiskSpace(path string, minFreeMB int) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		free, err := diskFree(path)
+		if err != nil {
+			return err
+		}
+		if free < uint64(minFreeMB)<<20 {
+			return fmt.Errorf("%d MB available, less than %d MB", free>>20, minFreeMB)
+		}
+		return nil
+	}
+}
+
+// checkDependency fails when the URL can't be reached or answers with a
+// server error.
+func checkDependency(client *http.Client, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// diskFree isn't implemented on systems without statfs.
+func diskFree(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// diskFree returns the bytes available to unprivileged users on the file
+// system of the path.
+func diskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"  // #nosec G501 -- required to verify apr1 hashes
+	"crypto/sha1" // #nosec G505 -- required to verify {SHA} hashes
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyBcryptHash is compared against for unknown users, so that the response
+// time doesn't reveal which usernames exist.
+var dummyBcryptHash = []byte("$2a$10$h1Vqjb7juX6cUj/N9O.zM.CPsFP.HBsMYx/5Nr.Cwtykxw.vC8MbS")
+
+// htpasswdFile holds the users of an Apache-style htpasswd file. Passwords
+// may be hashed with bcrypt, SHA-1 ({SHA}) or MD5 (apr1).
+type htpasswdFile struct {
+	path string
+
+	mu      sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+}
+
+func loadHtpasswdFile(path string) (*htpasswdFile, error) {
+	f := &htpasswdFile{path: filepath.Clean(path)}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *htpasswdFile) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.users = users
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return nil
+}
+
+func parseHtpasswd(data []byte) (map[string]string, error) {
+	users := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, found := strings.Cut(line, ":")
+		if !found || username == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", lineNumber)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") && !strings.HasPrefix(hash, "$apr1$") {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %q (must be bcrypt, SHA or apr1)", lineNumber, username)
+		}
+
+		users[username] = hash
+	}
+
+	return users, scanner.Err()
+}
+
+// watch reloads the file whenever its modification time or size changes.
+// The previous users are kept when the new file can't be loaded.
+func (f *htpasswdFile) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			slog.Error("Failed to check htpasswd file", "error", err)
+			continue
+		}
+
+		f.mu.RLock()
+		changed := !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+		f.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := f.reload(); err != nil {
+			slog.Error("Failed to reload htpasswd file, keeping previous users", "error", err)
+			continue
+		}
+		slog.Info("Reloaded htpasswd file", "path", f.path)
+	}
+}
+
+func (f *htpasswdFile) verify(username, password string) bool {
+	f.mu.RLock()
+	hash, exists := f.users[username]
+	f.mu.RUnlock()
+
+	if !exists {
+		_ = bcrypt.CompareHashAndPassword(dummyBcryptHash, []byte(password))
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password)) // #nosec G401 -- required by the {SHA} format
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	}
+	return false
+}
+
+// apr1 hashes the password with the Apache variant of the MD5-based crypt
+// algorithm.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password)) // #nosec G401 -- required by the apr1 format
+
+	h := md5.New() // #nosec G401 -- required by the apr1 format
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New() // #nosec G401 -- required by the apr1 format
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[idx[0]])<<16|uint32(final[idx[1]])<<8|uint32(final[idx[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return magic + salt + "$" + out.String()
+}
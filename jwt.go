@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// jwtLeeway is the allowed clock skew when checking exp and nbf claims.
+const jwtLeeway = 30 * time.Second
+
+var (
+	errInvalidToken         = errors.New("invalid token")
+	errRefreshTokenNotFound = errors.New("refresh token not found")
+)
+
+type jwtKey struct {
+	id         string
+	algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+type jwtIssuer struct {
+	issuer          string
+	audience        string
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	signingKey      *jwtKey
+	keys            map[string]*jwtKey
+	refreshTokens   refreshTokenStore
+}
+
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	ID        string   `json:"jti"`
+}
+
+// audience is the aud claim, which may be either a string or an array of
+// strings.
+type audience []string
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func newJWTIssuer(cfg jwtConfig, refreshTokens refreshTokenStore) (*jwtIssuer, error) {
+	keys, err := cfg.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwtIssuer{
+		issuer:          cfg.Issuer,
+		audience:        cfg.Audience,
+		accessTokenTTL:  time.Duration(cfg.AccessTokenTTL),
+		refreshTokenTTL: time.Duration(cfg.RefreshTokenTTL),
+		keys:            keys,
+		signingKey:      keys[cfg.SigningKey],
+		refreshTokens:   refreshTokens,
+	}, nil
+}
+
+// validate checks the token settings and loads the keys, so that missing or
+// invalid key files are reported with the rest of the configuration.
+func (cfg jwtConfig) validate() error {
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return errors.New("issuer and audience are required")
+	}
+	if cfg.AccessTokenTTL <= 0 || cfg.RefreshTokenTTL <= 0 {
+		return errors.New("token TTLs must be positive")
+	}
+	_, err := cfg.loadKeys()
+	return err
+}
+
+// loadKeys reads the keys from their files, and checks that the signing key
+// is one of them.
+func (cfg jwtConfig) loadKeys() (map[string]*jwtKey, error) {
+	keys := map[string]*jwtKey{}
+	for _, kc := range cfg.Keys {
+		if _, exists := keys[kc.ID]; exists {
+			return nil, fmt.Errorf("duplicate key %q", kc.ID)
+		}
+		key := &jwtKey{id: kc.ID, algorithm: kc.Algorithm}
+
+		switch kc.Algorithm {
+		case "HS256":
+			secret, err := os.ReadFile(filepath.Clean(kc.SecretFile))
+			if err != nil {
+				return nil, fmt.Errorf("read secret for key %q: %v", kc.ID, err)
+			}
+			key.secret = bytes.TrimSpace(secret)
+			if len(key.secret) < 32 {
+				return nil, fmt.Errorf("secret for key %q must be at least 32 bytes", kc.ID)
+			}
+		case "EdDSA":
+			privateKey, err := loadEd25519PrivateKey(kc.PrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load private key for key %q: %v", kc.ID, err)
+			}
+			key.privateKey = privateKey
+			key.publicKey = privateKey.Public().(ed25519.PublicKey)
+		default:
+			return nil, fmt.Errorf("unsupported algorithm %q for key %q", kc.Algorithm, kc.ID)
+		}
+
+		keys[kc.ID] = key
+	}
+
+	if keys[cfg.SigningKey] == nil {
+		return nil, fmt.Errorf("signing key %q is not configured", cfg.SigningKey)
+	}
+	return keys, nil
+}
+
+func loadEd25519PrivateKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return privateKey, nil
+}
+
+func (key *jwtKey) sign(data []byte) []byte {
+	if key.algorithm == "EdDSA" {
+		return ed25519.Sign(key.privateKey, data)
+	}
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (key *jwtKey) verify(data, signature []byte) bool {
+	if key.algorithm == "EdDSA" {
+		return ed25519.Verify(key.publicKey, data, signature)
+	}
+	return hmac.Equal(key.sign(data), signature)
+}
+
+func (j *jwtIssuer) issueAccessToken(subject string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("generate token id: %v", err)
+	}
+
+	now := time.Now()
+	claims := jwtClaims{
+		Issuer:    j.issuer,
+		Subject:   subject,
+		Audience:  audience{j.audience},
+		ExpiresAt: now.Add(j.accessTokenTTL).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        hex.EncodeToString(jti),
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": j.signingKey.algorithm, "typ": "JWT", "kid": j.signingKey.id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := j.signingKey.sign([]byte(signingInput))
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyAccessToken checks the signature and the registered claims of the
+// token and returns its claims.
+func (j *jwtIssuer) verifyAccessToken(token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return jwtClaims{}, errInvalidToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return jwtClaims{}, errInvalidToken
+	}
+
+	// The algorithm must match the key, otherwise a public key could be
+	// used as an HMAC secret
+	key, exists := j.keys[header.KeyID]
+	if !exists || key.algorithm != header.Algorithm {
+		return jwtClaims{}, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return jwtClaims{}, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return jwtClaims{}, errInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return jwtClaims{}, errInvalidToken
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return jwtClaims{}, fmt.Errorf("%w: token has expired", errInvalidToken)
+	}
+	if now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return jwtClaims{}, fmt.Errorf("%w: token is not valid yet", errInvalidToken)
+	}
+	if claims.Issuer != j.issuer {
+		return jwtClaims{}, fmt.Errorf("%w: unexpected issuer", errInvalidToken)
+	}
+	audienceMatch := false
+	for _, aud := range claims.Audience {
+		if aud == j.audience {
+			audienceMatch = true
+		}
+	}
+	if !audienceMatch {
+		return jwtClaims{}, fmt.Errorf("%w: unexpected audience", errInvalidToken)
+	}
+
+	return claims, nil
+}
+
+// bearerToken returns the token from the Authorization header of the request,
+// if there is one.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// refreshTokenStore keeps hashes of issued refresh tokens. Refresh tokens are
+// single-use: consume removes the token and returns its subject.
+type refreshTokenStore interface {
+	create(ctx context.Context, hash, subject string, expiresAt time.Time) error
+	consume(ctx context.Context, hash string) (string, error)
+}
+
+type memoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]refreshToken
+}
+
+type refreshToken struct {
+	subject   string
+	expiresAt time.Time
+}
+
+func newMemoryRefreshTokenStore() *memoryRefreshTokenStore {
+	return &memoryRefreshTokenStore{tokens: map[string]refreshToken{}}
+}
+
+func (s *memoryRefreshTokenStore) create(ctx context.Context, hash, subject string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[hash] = refreshToken{subject: subject, expiresAt: expiresAt}
+
+	// Forget the tokens that expired without being used
+	now := time.Now()
+	for k, token := range s.tokens {
+		if now.After(token.expiresAt) {
+			delete(s.tokens, k)
+		}
+	}
+	return nil
+}
+
+func (s *memoryRefreshTokenStore) consume(ctx context.Context, hash string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, exists := s.tokens[hash]
+	if !exists {
+		return "", errRefreshTokenNotFound
+	}
+	delete(s.tokens, hash)
+
+	if time.Now().After(token.expiresAt) {
+		return "", errRefreshTokenNotFound
+	}
+	return token.subject, nil
+}
+
+type postgresRefreshTokenStore struct {
+	db *pgxpool.Pool
+}
+
+func (s *postgresRefreshTokenStore) create(ctx context.Context, hash, subject string, expiresAt time.Time) error {
+	// Forget the tokens that expired without being used
+	if _, err := s.db.Exec(ctx, "DELETE FROM refresh_tokens WHERE expires_at < now()"); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(ctx, "INSERT INTO refresh_tokens(hash, subject, expires_at) VALUES ($1, $2, $3)", hash, subject, expiresAt)
+	return err
+}
+
+func (s *postgresRefreshTokenStore) consume(ctx context.Context, hash string) (string, error) {
+	var subject string
+	var expiresAt time.Time
+	err := s.db.QueryRow(ctx, "DELETE FROM refresh_tokens WHERE hash = $1 RETURNING subject, expires_at", hash).Scan(&subject, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errRefreshTokenNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if time.Now().After(expiresAt) {
+		return "", errRefreshTokenNotFound
+	}
+	return subject, nil
+}
+
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (app *application) issueTokens(ctx context.Context, subject string) (tokenResponse, error) {
+	accessToken, err := app.jwt.issueAccessToken(subject)
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("issue access token: %v", err)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return tokenResponse{}, fmt.Errorf("generate refresh token: %v", err)
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(b)
+
+	err = app.jwt.refreshTokens.create(ctx, hashRefreshToken(refreshToken), subject, time.Now().Add(app.jwt.refreshTokenTTL))
+	if err != nil {
+		return tokenResponse{}, fmt.Errorf("store refresh token: %v", err)
+	}
+
+	return tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(app.jwt.accessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// createToken exchanges credentials or a refresh token for a new access
+// token and refresh token pair.
+func (app *application) createToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		GrantType    string `json:"grant_type"`
+		Username     string `json:"username"`
+		Password     string `json:"password"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	var subject string
+
+	switch req.GrantType {
+	case "password":
+		if err := app.verifyPassword(r, req.Username, req.Password); err != nil {
+			if retryAfter, ok := retryAfterFromError(err); ok {
+				setRetryAfter(w, retryAfter)
+				writeProblem(w, r, http.StatusTooManyRequests, "Too many failed attempts")
+				return
+			}
+			if errors.Is(err, errInvalidCredentials) {
+				writeProblem(w, r, http.StatusUnauthorized, "Invalid username or password")
+				return
+			}
+			requestLogger(r).Error("Failed to verify password", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		subject = req.Username
+	case "refresh_token":
+		var err error
+		subject, err = app.jwt.refreshTokens.consume(r.Context(), hashRefreshToken(req.RefreshToken))
+		if err != nil {
+			if errors.Is(err, errRefreshTokenNotFound) {
+				writeProblem(w, r, http.StatusUnauthorized, "Invalid refresh token")
+				return
+			}
+			requestLogger(r).Error("Failed to consume refresh token", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	default:
+		writeProblem(w, r, http.StatusBadRequest, "Unsupported grant_type (must be password or refresh_token)")
+		return
+	}
+
+	tokens, err := app.issueTokens(r.Context(), subject)
+	if err != nil {
+		requestLogger(r).Error("Failed to issue tokens", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(tokens)
+	if err != nil {
+		requestLogger(r).Error("Failed to encode tokens", "error", err)
+		return
+	}
+}
+
+// jwksHandler publishes the public keys used to sign access tokens, so that
+// other services can verify them without calling this server. HS256 secrets
+// are never published.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	type jwk struct {
+		KeyType   string `json:"kty"`
+		Curve     string `json:"crv"`
+		X         string `json:"x"`
+		KeyID     string `json:"kid"`
+		Algorithm string `json:"alg"`
+		Use       string `json:"use"`
+	}
+
+	keys := []jwk{}
+	for _, key := range app.jwt.keys {
+		if key.algorithm != "EdDSA" {
+			continue
+		}
+		keys = append(keys, jwk{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.publicKey),
+			KeyID:     key.id,
+			Algorithm: key.algorithm,
+			Use:       "sig",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	err := json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+	if err != nil {
+		requestLogger(r).Error("Failed to encode JWKS", "error", err)
+		return
+	}
+}
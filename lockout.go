@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// lockedOutError is returned when too many failed attempts were made for a
+// username or from a client address.
+type lockedOutError struct {
+	retryAfter time.Duration
+}
+
+func (e *lockedOutError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry after %s", e.retryAfter)
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// failureStore counts failed authentication attempts by key. Keys are
+// "user:<username>" and "ip:<address>". Attempts are recorded as pending
+// before the credentials are checked, so that concurrent attempts see each
+// other.
+type failureStore interface {
+	// attempt records a pending attempt and returns the number of failures
+	// within the window, the number of pending attempts, including this
+	// one, and the time until which the key is locked.
+	attempt(ctx context.Context, key string, window time.Duration) (failures, pending int, lockedUntil time.Time, err error)
+	// done ends a pending attempt, counting it as a failure if it failed,
+	// and returns the number of failures.
+	done(ctx context.Context, key string, failed bool) (int, error)
+	lock(ctx context.Context, key string, until time.Time) error
+	reset(ctx context.Context, key string) error
+}
+
+type failureRecord struct {
+	failures    int
+	pending     int
+	lastAttempt time.Time
+	lockedUntil time.Time
+}
+
+type memoryFailureStore struct {
+	mu      sync.Mutex
+	records map[string]failureRecord
+}
+
+func newMemoryFailureStore() *memoryFailureStore {
+	return &memoryFailureStore{records: map[string]failureRecord{}}
+}
+
+func (s *memoryFailureStore) attempt(ctx context.Context, key string, window time.Duration) (int, int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	record := s.records[key]
+	if now.Sub(record.lastAttempt) > window {
+		record.failures = 0
+		record.pending = 0
+	}
+	record.pending++
+	record.lastAttempt = now
+	s.records[key] = record
+
+	// Forget records that are no longer relevant
+	for k, r := range s.records {
+		if now.Sub(r.lastAttempt) > window && now.After(r.lockedUntil) {
+			delete(s.records, k)
+		}
+	}
+
+	return record.failures, record.pending, record.lockedUntil, nil
+}
+
+func (s *memoryFailureStore) done(ctx context.Context, key string, failed bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := s.records[key]
+	record.pending = max(record.pending-1, 0)
+	if failed {
+		record.failures++
+		record.lastAttempt = time.Now()
+	}
+	s.records[key] = record
+	return record.failures, nil
+}
+
+func (s *memoryFailureStore) lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := s.records[key]
+	record.lockedUntil = until
+	s.records[key] = record
+	return nil
+}
+
+func (s *memoryFailureStore) reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+type postgresFailureStore struct {
+	db *pgxpool.Pool
+}
+
+func (s *postgresFailureStore) attempt(ctx context.Context, key string, window time.Duration) (int, int, time.Time, error) {
+	var failures, pending int
+	var until time.Time
+	err := s.db.QueryRow(ctx, `INSERT INTO auth_failures(key, failures, pending, last_failure) VALUES ($1, 0, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN auth_failures.last_failure < now() - make_interval(secs => $2) THEN 0 ELSE auth_failures.failures END,
+			pending = CASE WHEN auth_failures.last_failure < now() - make_interval(secs => $2) THEN 1 ELSE auth_failures.pending + 1 END,
+			last_failure = now()
+		RETURNING failures, pending, COALESCE(locked_until, 'epoch')`, key, window.Seconds()).Scan(&failures, &pending, &until)
+	return failures, pending, until, err
+}
+
+func (s *postgresFailureStore) done(ctx context.Context, key string, failed bool) (int, error) {
+	increment := 0
+	if failed {
+		increment = 1
+	}
+	var failures int
+	err := s.db.QueryRow(ctx, `INSERT INTO auth_failures(key, failures, pending, last_failure) VALUES ($1, $2, 0, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = auth_failures.failures + $2,
+			pending = GREATEST(auth_failures.pending - 1, 0)
+		RETURNING failures`, key, increment).Scan(&failures)
+	return failures, err
+}
+
+func (s *postgresFailureStore) lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.db.Exec(ctx, "UPDATE auth_failures SET locked_until = $1 WHERE key = $2", until, key)
+	return err
+}
+
+func (s *postgresFailureStore) reset(ctx context.Context, key string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM auth_failures WHERE key = $1", key)
+	return err
+}
+
+// trustedProxies are the addresses allowed to forward the address of the
+// client in the X-Client-IP header, set from the configuration at startup.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses addresses and CIDR ranges, e.g. "10.0.0.0/8".
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid address or range %q", proxy)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientIP returns the address of the client: the remote address of the
+// connection, or the address forwarded by nginx in the X-Client-IP header
+// when the connection comes from a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	forwarded := r.Header.Get("X-Client-IP")
+	if forwarded == "" {
+		return host
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range trustedProxies {
+			if prefix.Contains(addr) {
+				return forwarded
+			}
+		}
+	}
+	return host
+}
+
+// backoff returns how long a key is locked after the given number of
+// failures: nothing for the free attempts, then an exponentially growing
+// delay capped at the lockout duration.
+func (cfg lockoutConfig) backoff(failures int) time.Duration {
+	if failures <= cfg.FreeAttempts {
+		return 0
+	}
+
+	exponent := min(failures-cfg.FreeAttempts-1, 30)
+	delay := time.Duration(cfg.BaseDelay) << exponent
+	if delay <= 0 || delay > time.Duration(cfg.LockoutDuration) {
+		return time.Duration(cfg.LockoutDuration)
+	}
+	return delay
+}
+
+// verifyPassword checks the credentials like checkCredentials, while
+// throttling failed attempts per username and per client address. It returns
+// a *lockedOutError when the username or the client is locked.
+//
+// Attempts are recorded before the credentials are checked, and only as many
+// are checked at a time as there are failures left before the next lockout,
+// so that a burst of concurrent guesses can't get past the backoff.
+func (app *application) verifyPassword(r *http.Request, username, password string) error {
+	if app.failures == nil {
+		if !app.checkCredentials(username, password) {
+			return errInvalidCredentials
+		}
+		return nil
+	}
+
+	ctx := r.Context()
+	keys := []string{"user:" + username, "ip:" + clientIP(r)}
+	done := func(keys []string, failed bool) (time.Duration, error) {
+		var retryAfter time.Duration
+		for _, key := range keys {
+			failures, err := app.failures.done(ctx, key, failed)
+			if err != nil {
+				return 0, fmt.Errorf("record attempt: %v", err)
+			}
+			delay := app.lockout.backoff(failures)
+			if !failed || delay == 0 {
+				continue
+			}
+			if err := app.failures.lock(ctx, key, time.Now().Add(delay)); err != nil {
+				return 0, fmt.Errorf("lock: %v", err)
+			}
+			retryAfter = max(retryAfter, delay)
+		}
+		return retryAfter, nil
+	}
+
+	now := time.Now()
+	for i, key := range keys {
+		failures, pending, until, err := app.failures.attempt(ctx, key, time.Duration(app.lockout.Window))
+		if err != nil {
+			done(keys[:i], false)
+			return fmt.Errorf("record attempt: %v", err)
+		}
+
+		var retryAfter time.Duration
+		if until.After(now) {
+			retryAfter = until.Sub(now)
+		} else if pending > max(app.lockout.FreeAttempts-failures, 0)+1 {
+			// The attempts in progress may all fail and lock the key
+			retryAfter = time.Duration(app.lockout.BaseDelay)
+		}
+		if retryAfter > 0 {
+			if _, err := done(keys[:i+1], false); err != nil {
+				requestLogger(r).Error("Failed to record attempt", "error", err)
+			}
+			return &lockedOutError{retryAfter: retryAfter}
+		}
+	}
+
+	if app.checkCredentials(username, password) {
+		if err := app.failures.reset(ctx, keys[0]); err != nil {
+			requestLogger(r).Error("Failed to reset failed attempts", "error", err)
+		}
+		if _, err := done(keys[1:], false); err != nil {
+			requestLogger(r).Error("Failed to record attempt", "error", err)
+		}
+		return nil
+	}
+
+	retryAfter, err := done(keys, true)
+	if err != nil {
+		return err
+	}
+	if retryAfter > 0 {
+		requestLogger(r).Warn("Locked out after failed attempts", "username", username, "client_ip", clientIP(r), "retry_after", retryAfter)
+		return &lockedOutError{retryAfter: retryAfter}
+	}
+	return errInvalidCredentials
+}
+
+// unlockHandler clears the failed attempts of a username or a client
+// address, e.g. {"username": "alice"} or {"ip": "203.0.113.7"}.
+func (app *application) unlockHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		IP       string `json:"ip"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	var keys []string
+	if req.Username != "" {
+		keys = append(keys, "user:"+req.Username)
+	}
+	if req.IP != "" {
+		keys = append(keys, "ip:"+req.IP)
+	}
+	if len(keys) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Missing field: username or ip")
+		return
+	}
+
+	for _, key := range keys {
+		if err := app.failures.reset(r.Context(), key); err != nil {
+			requestLogger(r).Error("Failed to unlock", "key", key, "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// retryAfterFromError returns the retry delay when err is a *lockedOutError.
+func retryAfterFromError(err error) (time.Duration, bool) {
+	var lockedOut *lockedOutError
+	if errors.As(err, &lockedOut) {
+		return lockedOut.retryAfter, true
+	}
+	return 0, false
+}
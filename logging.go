@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// logLevel is the minimum level of the logger returned by newLogger, which
+// can be changed while the server runs.
+var logLevel slog.LevelVar
+
+func (cfg logConfig) level() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+	return level, nil
+}
+
+func (cfg logConfig) validate() error {
+	if _, err := cfg.level(); err != nil {
+		return err
+	}
+	if cfg.Format != "json" && cfg.Format != "text" {
+		return fmt.Errorf("invalid log format %q (must be json or text)", cfg.Format)
+	}
+	return nil
+}
+
+// newLogger returns a logger writing to stderr in the configured format and
+// from the configured level on.
+func newLogger(cfg logConfig) (*slog.Logger, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	level, _ := cfg.level()
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: &logLevel}
+
+	if cfg.Format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+}
+
+// fatal logs the error and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type loggerContextKey struct{}
+
+// requestLogger returns the logger of the request, which adds the request ID
+// to every record, or the default logger outside of requests.
+func requestLogger(r *http.Request) *slog.Logger {
+	return loggerFromContext(r.Context())
+}
+
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestLogInfo collects what is learned about a request while it's handled,
+// for its line in the log.
+type requestLogInfo struct {
+	pattern string
+	user    string
+}
+
+type requestLogInfoContextKey struct{}
+
+func logInfoFromContext(ctx context.Context) *requestLogInfo {
+	info, _ := ctx.Value(requestLogInfoContextKey{}).(*requestLogInfo)
+	return info
+}
+
+// recordRoute notes the pattern of the route the mux matched. The mux sets
+// it on the request it's given, which the handlers wrapping it don't see.
+func recordRoute(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if info := logInfoFromContext(r.Context()); info != nil && info.pattern == "" {
+			info.pattern = r.Pattern
+		}
+	})
+}
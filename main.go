@@ -5,13 +5,17 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,6 +30,24 @@ type application struct {
 	}
 	db             *pgxpool.Pool
 	enabledModules map[string]bool
+	sessions       sessionStore
+	sessionConfig  sessionConfig
+	jwt            *jwtIssuer
+	apiKeys        apiKeyStore
+	roles          rolesConfig
+	oidc           *oidcProvider
+	htpasswd       *htpasswdFile
+	failures       failureStore
+	lockout        lockoutConfig
+	rateLimiter    rateLimiter
+	rateLimits     atomic.Pointer[rateLimitConfig]
+	metrics        *httpMetrics
+	shutdown       *shutdownCoordinator
+	// config is the current configuration, parts of which are applied live
+	// when it's reloaded
+	config     atomic.Pointer[config]
+	configArgs []string
+	reloadMu   sync.Mutex
 	// pb.UnimplementedHttpServerServiceServer
 }
 
@@ -35,36 +57,143 @@ func main() {
 	app := new(application)
 
 	app.enabledModules = map[string]bool{}
+	app.shutdown = newShutdownCoordinator()
 
-	cfg, err := loadConfig("config.yaml")
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		// Report every problem at once
+		for _, err := range configErrors(err) {
+			slog.Error("Invalid configuration", "error", err)
+		}
+		os.Exit(1)
+	}
+	app.config.Store(&cfg)
+	app.configArgs = os.Args[1:]
+	trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies)
+
+	logger, err := newLogger(cfg.Log)
 	if err != nil {
-		log.Fatalf("Failed to load configuration from file: %v\n", err)
+		fatal("Invalid log configuration", "error", err)
 	}
+	slog.SetDefault(logger)
 
 	for _, module := range cfg.Modules {
 		app.enabledModules[module] = true
 	}
 
+	if app.enabledModules["tracing"] {
+		provider, err := newTracerProvider(context.Background(), cfg.Tracing)
+		if err != nil {
+			fatal("Failed to set up tracing", "error", err)
+		}
+		app.shutdown.onShutdown("tracing", provider.Shutdown)
+	}
+
 	if app.enabledModules["database"] {
+		poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseURL)
+		if err != nil {
+			fatal("Invalid database URL", "error", err)
+		}
+		if app.enabledModules["tracing"] {
+			poolConfig.ConnConfig.Tracer = queryTracer{}
+		}
+
 		// Create concurrency safe database connection pool
-		dbpool, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
+		dbpool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 		if err != nil {
-			log.Fatalf("Unable to connect to database: %v\n", err)
+			fatal("Unable to connect to database", "error", err)
 		}
-		defer dbpool.Close()
 		app.db = dbpool
+		app.shutdown.onShutdown("database", func(ctx context.Context) error {
+			dbpool.Close()
+			return nil
+		})
+	}
+
+	if app.enabledModules["ratelimit"] {
+		rateLimits, err := cfg.RateLimit.normalize()
+		if err != nil {
+			fatal("Invalid rate limit configuration", "error", err)
+		}
+		app.rateLimits.Store(&rateLimits)
+
+		// Keep the buckets in the database, so that limits hold across
+		// replicas
+		if app.enabledModules["database"] {
+			app.rateLimiter = &postgresRateLimiter{db: app.db, longestRefill: func() time.Duration {
+				return app.rateLimits.Load().longestRefill()
+			}}
+		} else {
+			app.rateLimiter = newMemoryRateLimiter()
+		}
 	}
 
 	if app.enabledModules["auth"] {
-		// Get credentials for basic authentication
-		app.auth.username = os.Getenv("AUTH_USERNAME")
-		if app.auth.username == "" {
-			log.Fatal("Missing AUTH_USERNAME environmental variable")
+		if cfg.Auth.HtpasswdFile != "" {
+			// Get users for basic authentication from the htpasswd file
+			app.htpasswd, err = loadHtpasswdFile(cfg.Auth.HtpasswdFile)
+			if err != nil {
+				fatal("Failed to load htpasswd file", "error", err)
+			}
+			// A zero interval disables reloading
+			if cfg.Auth.ReloadInterval > 0 {
+				go app.htpasswd.watch(time.Duration(cfg.Auth.ReloadInterval))
+			}
+		} else {
+			// Get credentials for basic authentication
+			app.auth.username = cfg.Auth.Username
+			app.auth.password = cfg.Auth.Password
+		}
+
+		// Store web UI sessions alongside the posts
+		if app.enabledModules["database"] {
+			app.sessions = &postgresSessionStore{db: app.db}
+		} else {
+			app.sessions = newMemorySessionStore()
+		}
+		app.sessionConfig = cfg.Session
+
+		// Throttle failed password attempts, sharing the state between
+		// replicas through the database
+		if app.enabledModules["database"] {
+			app.failures = &postgresFailureStore{db: app.db}
+		} else {
+			app.failures = newMemoryFailureStore()
+		}
+		app.lockout = cfg.Lockout
+
+		app.roles = cfg.Roles
+	}
+
+	if app.enabledModules["jwt"] {
+		var refreshTokens refreshTokenStore = newMemoryRefreshTokenStore()
+		if app.enabledModules["database"] {
+			refreshTokens = &postgresRefreshTokenStore{db: app.db}
+		}
+
+		app.jwt, err = newJWTIssuer(cfg.JWT, refreshTokens)
+		if err != nil {
+			fatal("Failed to configure JWT", "error", err)
+		}
+	}
+
+	if app.enabledModules["oidc"] {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		app.oidc, err = newOIDCProvider(ctx, cfg.OIDC)
+		cancel()
+		if err != nil {
+			fatal("Failed to configure OIDC provider", "error", err)
 		}
+	}
 
-		app.auth.password = os.Getenv("AUTH_PASSWORD")
-		if app.auth.password == "" {
-			log.Fatal("Missing AUTH_PASSWORD environmental variable")
+	if app.enabledModules["apikeys"] {
+		if app.enabledModules["database"] {
+			app.apiKeys = &postgresAPIKeyStore{db: app.db}
+		} else {
+			app.apiKeys = newMemoryAPIKeyStore()
 		}
 	}
 
@@ -86,19 +215,91 @@ func main() {
 	// Define routes
 	mux := http.NewServeMux()
 	if app.enabledModules["webui"] {
-		mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+		mux.Handle("GET /static/", http.StripPrefix("/static/", precompressedFileServer("static")))
 		mux.HandleFunc("GET /{$}", app.rootHandler)
+		if app.enabledModules["auth"] {
+			mux.HandleFunc("GET /login", app.loginPageHandler)
+			app.handle(mux, "POST /login", app.loginHandler)
+			mux.HandleFunc("POST /logout", app.logoutHandler)
+		}
+		if app.enabledModules["oidc"] {
+			app.handle(mux, "GET /login/oidc", app.oidcLoginHandler)
+			app.handle(mux, "GET /login/oidc/callback", app.oidcCallbackHandler)
+		}
 	} else {
 		mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, "/api/v1/posts", http.StatusMovedPermanently)
 		})
 	}
-	mux.HandleFunc("GET /api/v1/posts", app.getPosts)
-	mux.HandleFunc("GET /api/v1/posts/{id}", app.getPost)
-	mux.Handle("POST /api/v1/posts", app.basicAuthMiddleware(enforceJSONMiddleware(app.createPost)))
-	mux.Handle("PUT /api/v1/posts/{id}", app.basicAuthMiddleware(enforceJSONMiddleware(app.updatePost)))
-	mux.Handle("DELETE /api/v1/posts/{id}", app.basicAuthMiddleware(app.deletePost))
-	mux.HandleFunc("GET /api/v1/healthz", app.healthCheckHandler)
+	app.handle(mux, "GET /api/v1/posts", app.getPosts)
+	app.handle(mux, "GET /api/v1/posts/{id}", app.getPost)
+	app.handle(mux, "POST /api/v1/posts", enforceJSONMiddleware(app.createPost))
+	app.handle(mux, "PUT /api/v1/posts/{id}", enforceJSONMiddleware(app.updatePost))
+	app.handle(mux, "DELETE /api/v1/posts/{id}", app.deletePost)
+	liveness, readiness := app.healthChecks(cfg.Health)
+	mux.Handle("GET /livez", liveness)
+	mux.Handle("GET /readyz", readiness)
+	mux.Handle("GET /api/v1/healthz", readiness)
+	if app.enabledModules["auth"] {
+		app.handle(mux, "POST /api/v1/lockouts/unlock", enforceJSONMiddleware(app.unlockHandler))
+	}
+	if app.enabledModules["jwt"] {
+		app.handle(mux, "POST /api/v1/tokens", enforceJSONMiddleware(app.createToken))
+		mux.HandleFunc("GET /.well-known/jwks.json", app.jwksHandler)
+	}
+	if app.enabledModules["apikeys"] {
+		app.handle(mux, "POST /api/v1/keys", enforceJSONMiddleware(app.createAPIKey))
+		app.handle(mux, "GET /api/v1/keys", app.listAPIKeys)
+		app.handle(mux, "DELETE /api/v1/keys/{id}", app.revokeAPIKey)
+	}
+	if app.enabledModules["metrics"] {
+		app.metrics = newHTTPMetrics()
+		if cfg.Metrics.Listen == "" {
+			app.handle(mux, "GET /metrics", app.metricsHandler)
+		}
+	}
+	if app.enabledModules["debug"] && cfg.Debug.Listen == "" {
+		app.handle(mux, "/debug/", debugHandler().ServeHTTP)
+	}
+	mux.HandleFunc("/", notFoundHandler(mux))
+
+	// Browsers send violation reports with the session cookie but without a
+	// CSRF token, so the report endpoint is outside of the CSRF protection
+	routes := http.NewServeMux()
+	routes.Handle("/", csrfMiddleware(app.csrfTrustedOrigin, recordRoute(mux)))
+	if cfg.SecurityHeaders.ReportURI == cspReportPath {
+		// Reports are logged, so they're limited even without the ratelimit
+		// module, which limits them by client address otherwise
+		report := cspReportHandler
+		if !app.enabledModules["ratelimit"] {
+			report = cspReportLimitMiddleware(report)
+		}
+		app.handle(routes, "POST /csp-report", report)
+	}
+
+	var accessLog *accessLogger
+	if cfg.AccessLog.File != "" {
+		accessLog, err = newAccessLogger(cfg.AccessLog)
+		if err != nil {
+			fatal("Failed to open access log", "error", err)
+		}
+		accessLog.reopenOnSignal()
+		app.shutdown.onShutdown("access log", func(ctx context.Context) error {
+			return accessLog.out.Close()
+		})
+	}
+
+	var handler http.Handler = recordRoute(routes)
+	handler = app.whenModuleEnabled("compression", compressionMiddleware(handler), handler)
+	corsConfig := func() corsConfig { return app.currentConfig().CORS }
+	handler = app.whenModuleEnabled("cors", corsMiddleware(corsConfig, mux, handler), handler)
+	handler = securityHeadersMiddleware(cfg.SecurityHeaders, handler)
+	if app.enabledModules["tracing"] {
+		handler = tracingMiddleware(handler)
+	}
+	if app.enabledModules["metrics"] {
+		handler = app.metrics.middleware(handler)
+	}
 
 	// // Main HTTPS server
 	// httpsServer := &http.Server{
@@ -120,62 +321,156 @@ func main() {
 	// }()
 
 	// HTTP server for redirects to HTTPS
-	httpServer := &http.Server{
-		Addr: fmt.Sprintf(":%d", cfg.Port),
-		// Handler: requestLoggerMiddleware(httpsRedirectMiddleware(http.NotFoundHandler())),
-		Handler:           requestLoggerMiddleware(mux),
-		ReadTimeout:       5 * time.Second,
-		WriteTimeout:      10 * time.Second,
-		IdleTimeout:       30 * time.Second,
-		ReadHeaderTimeout: 2 * time.Second,
-	}
+	// Handler: requestLoggerMiddleware(httpsRedirectMiddleware(http.NotFoundHandler())),
+	httpServer := newHTTPServer(cfg.Server, fmt.Sprintf(":%d", cfg.Port), app.serverTimeoutMiddleware(requestIDMiddleware(requestLoggerMiddleware(accessLog, handler))))
 
 	// Start HTTP server
 	go func() {
 		// log.Printf("HTTP Server is listening on %s for redirection\n", addr)
-		log.Printf("HTTP Server is listening on :%d\n", cfg.Port)
+		slog.Info("HTTP Server is listening", "port", cfg.Port)
 		err := httpServer.ListenAndServe()
 		if !errors.Is(err, http.ErrServerClosed) {
-			log.Fatal(err)
+			fatal("HTTP Server failed", "error", err)
 		}
 	}()
 
+	// Admin servers, kept off the public port. They stay available while
+	// requests drain
+	if app.enabledModules["metrics"] && cfg.Metrics.Listen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET /metrics", app.metricsHandler)
+		metricsServer := startAdminServer("metrics", cfg.Metrics.Listen, metricsMux)
+		app.shutdown.onShutdown("metrics server", metricsServer.Shutdown)
+	}
+	if app.enabledModules["debug"] && cfg.Debug.Listen != "" {
+		debugServer := startAdminServer("debug", cfg.Debug.Listen, debugHandler())
+		app.shutdown.onShutdown("debug server", debugServer.Shutdown)
+	}
+
+	if app.enabledModules["debug"] && cfg.Debug.Profiling.Dir != "" {
+		p, err := newProfiler(cfg.Debug.Profiling)
+		if err != nil {
+			fatal("Invalid profiling configuration", "error", err)
+		}
+		profilingCtx, stopProfiling := context.WithCancel(context.Background())
+		go p.run(profilingCtx)
+		app.shutdown.onShutdown("profiler", func(ctx context.Context) error {
+			stopProfiling()
+			return nil
+		})
+	}
+
+	// Apply configuration changes on SIGHUP, and when the file changes
+	app.reloadOnSignal()
+	if cfg.file != "" {
+		go app.watchConfig()
+	}
+
 	// Graceful shutdown
 	shutdownError := make(chan error)
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 		s := <-quit
-		log.Printf("Shutting down server: %v\n", s)
+		slog.Info("Shutting down server", "signal", s.String())
+
+		// Fail readiness first and keep serving for a while, so that load
+		// balancers stop sending requests before the listener closes. New
+		// responses ask clients to reconnect, which takes them elsewhere
+		readiness.startDraining()
+		httpServer.SetKeepAlivesEnabled(false)
+		if delay := time.Duration(cfg.Shutdown.PreStopDelay); delay > 0 {
+			slog.Info("Waiting before draining connections", "delay", delay)
+			select {
+			case <-time.After(delay):
+			case s := <-quit:
+				slog.Info("Skipping the pre-stop delay", "signal", s.String())
+			}
+		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Shutdown.Timeout))
 		defer cancel()
 
 		// shutdownError <- httpsServer.Shutdown(ctx)
-		shutdownError <- httpServer.Shutdown(ctx)
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			slog.Error("Failed to drain connections", "error", err)
+			httpServer.Close()
+		}
+
+		// Release resources only once requests are done with them
+		app.shutdown.runHooks(time.Duration(cfg.Shutdown.HookTimeout))
+		shutdownError <- err
 	}()
 
 	err = <-shutdownError
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to shut down server", "error", err)
 	}
 
-	log.Print("Server has been stopped")
+	slog.Info("Server has been stopped")
 }
 
-func requestLoggerMiddleware(next http.Handler) http.Handler {
+// startAdminServer serves the handler on its own listener, for endpoints that
+// shouldn't be reachable through the public port.
+func startAdminServer(name, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           requestIDMiddleware(handler),
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+
+	go func() {
+		slog.Info("Admin server is listening", "server", name, "addr", addr)
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Admin server failed", "server", name, "error", err)
+		}
+	}()
+
+	return server
+}
+
+// requestLoggerMiddleware logs every request to the application log, with
+// the request id to correlate it with the other lines of the request, and
+// to the access log when there is one.
+func requestLoggerMiddleware(accessLog *accessLogger, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestLogInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), requestLogInfoContextKey{}, info))
+
 		rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
 		next.ServeHTTP(rec, r)
-		clientAddr := r.Header.Get("X-Client-IP")
-		log.Println(rec.statusCode, r.Method, r.URL.Path, r.RemoteAddr, clientAddr)
+
+		if accessLog != nil {
+			accessLog.log(r, rec, info, start)
+		}
+
+		level := slog.LevelInfo
+		if rec.statusCode >= 500 {
+			level = slog.LevelError
+		}
+		requestLogger(r).LogAttrs(r.Context(), level, "Request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", info.pattern),
+			slog.Int("status", rec.statusCode),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("user", info.user),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("client_ip", clientIP(r)),
+		)
 	})
 }
 
 // responseRecorder is a custom ResponseWriter that captures the status code
+// and counts the bytes of the body
 type responseRecorder struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (rec *responseRecorder) WriteHeader(code int) {
@@ -183,81 +478,124 @@ func (rec *responseRecorder) WriteHeader(code int) {
 	rec.ResponseWriter.WriteHeader(code)
 }
 
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends buffered data to the client, so that streamed responses pass
+// through the recorder.
+func (rec *responseRecorder) Flush() {
+	if err := http.NewResponseController(rec.ResponseWriter).Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Error("Failed to flush response", "error", err)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection's ResponseWriter.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+type rootPageData struct {
+	Posts       []post
+	AuthEnabled bool
+	User        string
+	CSRFToken   string
+	Nonce       string
+}
+
 func (app *application) rootHandler(w http.ResponseWriter, r *http.Request) {
-	postList, err := app.getPostsList()
+	postList, err := app.getPostsList(r.Context())
 	if err != nil {
-		log.Printf("Failed to get posts: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to get posts", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
 	tmpl, err := template.ParseFiles("./static/index.html")
 	if err != nil {
-		log.Printf("Failed to load template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to load template", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
-	if err := tmpl.Execute(w, postList); err != nil {
-		log.Printf("Failed to render template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	data := rootPageData{
+		Posts:       postList,
+		AuthEnabled: app.enabledModules["auth"],
+		User:        app.sessionUser(r),
+		CSRFToken:   csrfToken(w, r),
+		Nonce:       cspNonce(r),
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		requestLogger(r).Error("Failed to render template", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 }
 
-func (app *application) basicAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Return early if auth is disabled
-		if !app.enabledModules["auth"] {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		username, password, ok := r.BasicAuth()
-		if ok {
-			usernameHash := sha256.Sum256([]byte(username))
-			passwordHash := sha256.Sum256([]byte(password))
-			expectedUsernameHash := sha256.Sum256([]byte(app.auth.username))
-			expectedPasswordHash := sha256.Sum256([]byte(app.auth.password))
+var (
+	errNoCredentials      = errors.New("no credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
 
-			usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
-			passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+// authenticate identifies the caller of the request by a web UI session,
+// an API key, a bearer token or basic auth credentials, in that order.
+func (app *application) authenticate(r *http.Request) (principal, error) {
+	// A web UI session is accepted as an alternative to basic auth
+	if sess, ok := app.currentSession(r); ok {
+		if sess.Role != "" || strings.HasPrefix(sess.Username, oidcPrincipalPrefix) {
+			return rolePrincipal(sess.Username, sess.Role), nil
+		}
+		return app.userPrincipal(sess.Username), nil
+	}
 
-			if usernameMatch && passwordMatch {
-				next.ServeHTTP(w, r)
-				return
+	if key := r.Header.Get("X-API-Key"); key != "" && app.apiKeys != nil {
+		apiKey, err := app.apiKeys.lookup(r.Context(), hashAPIKey(key))
+		if err != nil {
+			if !errors.Is(err, errAPIKeyNotFound) {
+				requestLogger(r).Error("Failed to look up API key", "error", err)
 			}
+			return principal{}, errInvalidCredentials
 		}
+		return principal{name: "apikey:" + apiKey.ID, permissions: apiKey.Scopes}, nil
+	}
 
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	})
-}
-
-func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-
-	if app.enabledModules["database"] {
-		// Ping database
-		err = app.db.Ping(ctx)
+	if token, ok := bearerToken(r); ok && app.jwt != nil {
+		claims, err := app.jwt.verifyAccessToken(token)
 		if err != nil {
-			log.Printf("Database failure: %v", err)
-			http.Error(w, "Database failure", http.StatusInternalServerError)
-			return
+			return principal{}, err
 		}
+		return app.userPrincipal(claims.Subject), nil
 	}
 
-	w.WriteHeader(http.StatusOK)
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return principal{}, errNoCredentials
+	}
+	if err := app.verifyPassword(r, username, password); err != nil {
+		return principal{}, err
+	}
+	return app.userPrincipal(username), nil
+}
 
-	_, err = w.Write([]byte("OK"))
-	if err != nil {
-		log.Printf("Failed to write the data to the connection: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+// checkCredentials reports whether the username and password match the
+// configured credentials. The comparison is done in constant time.
+func (app *application) checkCredentials(username, password string) bool {
+	if app.htpasswd != nil {
+		return app.htpasswd.verify(username, password)
 	}
+
+	usernameHash := sha256.Sum256([]byte(username))
+	passwordHash := sha256.Sum256([]byte(password))
+	expectedUsernameHash := sha256.Sum256([]byte(app.auth.username))
+	expectedPasswordHash := sha256.Sum256([]byte(app.auth.password))
+
+	usernameMatch := (subtle.ConstantTimeCompare(usernameHash[:], expectedUsernameHash[:]) == 1)
+	passwordMatch := (subtle.ConstantTimeCompare(passwordHash[:], expectedPasswordHash[:]) == 1)
+
+	return usernameMatch && passwordMatch
 }
 
 func enforceJSONMiddleware(next http.HandlerFunc) http.HandlerFunc {
@@ -267,12 +605,12 @@ func enforceJSONMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		if contentType != "" {
 			mt, _, err := mime.ParseMediaType(contentType)
 			if err != nil {
-				http.Error(w, "Malformed Content-Type header", http.StatusBadRequest)
+				writeProblem(w, r, http.StatusBadRequest, "Malformed Content-Type header")
 				return
 			}
 
 			if mt != "application/json" {
-				http.Error(w, "Content-Type header must be application/json", http.StatusUnsupportedMediaType)
+				writeProblem(w, r, http.StatusUnsupportedMediaType, "Content-Type header must be application/json")
 				return
 			}
 		}
@@ -1,15 +1,1788 @@
 package main
 
 import (
-	// 	"net/http"
-	// 	"net/http/httptest"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func Test(t *testing.T) {
 	t.Name()
 }
 
+func TestSessionLogin(t *testing.T) {
+	app := &application{
+		enabledModules: map[string]bool{"auth": true},
+		roles:          rolesConfig{Default: roleViewer},
+		sessions:       newMemorySessionStore(),
+		sessionConfig:  sessionConfig{IdleTimeout: duration(time.Minute), AbsoluteTimeout: duration(time.Hour)},
+	}
+	app.auth.username = "user"
+	app.auth.password = "pass"
+
+	login := func(cookie *http.Cookie) *http.Cookie {
+		form := url.Values{"username": {"user"}, "password": {"pass"}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		app.loginHandler(w, req)
+
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("expected status %d, got %d", http.StatusSeeOther, w.Code)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || !cookies[0].HttpOnly || !cookies[0].Secure {
+			t.Fatalf("expected a secure HttpOnly session cookie, got %v", cookies)
+		}
+		return cookies[0]
+	}
+
+	first := login(nil)
+	second := login(first)
+	if first.Value == second.Value {
+		t.Error("expected session id to be rotated on login")
+	}
+
+	protected := app.authorize(routePolicies["POST /api/v1/posts"], func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for _, tc := range []struct {
+		cookie *http.Cookie
+		status int
+	}{
+		{first, http.StatusUnauthorized},
+		{second, http.StatusOK},
+	} {
+		req := httptest.NewRequest("POST", "/api/v1/posts", nil)
+		req.AddCookie(tc.cookie)
+		w := httptest.NewRecorder()
+		protected(w, req)
+		if w.Code != tc.status {
+			t.Errorf("expected status %d, got %d", tc.status, w.Code)
+		}
+	}
+
+	// Abandoned sessions are removed on the next login
+	stale := time.Now().Add(-2 * time.Hour)
+	app.sessions.create(context.Background(), session{ID: "abandoned", Username: "user", CreatedAt: stale, LastSeen: stale})
+	login(nil)
+	if _, err := app.sessions.get(context.Background(), "abandoned"); !errors.Is(err, errSessionNotFound) {
+		t.Errorf("expected abandoned session to be removed, got %v", err)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	handler := csrfMiddleware(nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	session := &http.Cookie{Name: sessionCookieName, Value: "session"}
+	csrf := &http.Cookie{Name: csrfCookieName, Value: "token"}
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		cookies []*http.Cookie
+		headers map[string]string
+		status  int
+	}{
+		{"safe method", "GET", []*http.Cookie{session}, nil, http.StatusOK},
+		{"api client", "POST", nil, nil, http.StatusOK},
+		{"session without token", "POST", []*http.Cookie{session, csrf}, nil, http.StatusForbidden},
+		{"session with wrong token", "POST", []*http.Cookie{session, csrf}, map[string]string{csrfHeaderName: "other"}, http.StatusForbidden},
+		{"session with token", "POST", []*http.Cookie{session, csrf}, map[string]string{csrfHeaderName: "token"}, http.StatusOK},
+		{"form without cookie", "POST", nil, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusForbidden},
+		{"cross-site", "POST", nil, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"cross-origin", "DELETE", nil, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"same origin", "POST", []*http.Cookie{session, csrf}, map[string]string{"Origin": "https://example.com", csrfHeaderName: "token"}, http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "https://example.com/api/v1/posts", nil)
+		for _, c := range tc.cookies {
+			req.AddCookie(c)
+		}
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+
+	// With the default CORS configuration, allowed origins may write with a
+	// Bearer token, but not with the session cookie
+	cfg := defaultConfig()
+	cfg.Modules = []string{"cors"}
+	cfg.CORS.AllowedOrigins = []string{"https://app.example"}
+	app := &application{}
+	app.config.Store(&cfg)
+	handler = csrfMiddleware(app.csrfTrustedOrigin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, tc := range []struct {
+		name    string
+		origin  string
+		cookies []*http.Cookie
+		status  int
+	}{
+		{"allowed origin with bearer token", "https://app.example", nil, http.StatusOK},
+		{"other origin with bearer token", "https://evil.example", nil, http.StatusForbidden},
+		{"allowed origin with session", "https://app.example", []*http.Cookie{session, csrf}, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("PUT", "https://example.com/api/v1/posts/1", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Origin", tc.origin)
+		req.Header.Set("Sec-Fetch-Site", "cross-site")
+		req.Header.Set(csrfHeaderName, "token")
+		for _, c := range tc.cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	cfg := securityHeadersConfig{
+		ContentSecurityPolicy: "script-src 'nonce-{nonce}'",
+		FrameAncestors:        "'none'",
+		ReportURI:             "/csp-report",
+		HSTSMaxAge:            duration(time.Hour),
+		HSTSIncludeSubdomains: true,
+		ReferrerPolicy:        "no-referrer",
+	}
+
+	var nonces []string
+	handler := securityHeadersMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, cspNonce(r))
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		expected := fmt.Sprintf("script-src 'nonce-%s'; frame-ancestors 'none'; report-uri /csp-report", nonces[i])
+		if csp := w.Header().Get("Content-Security-Policy"); csp != expected {
+			t.Errorf("expected policy %q, got %q", expected, csp)
+		}
+		if hsts := w.Header().Get("Strict-Transport-Security"); hsts != "max-age=3600; includeSubDomains" {
+			t.Errorf("unexpected Strict-Transport-Security %q", hsts)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Referrer-Policy") != "no-referrer" {
+			t.Errorf("missing headers: %v", w.Header())
+		}
+		if w.Header().Get("Permissions-Policy") != "" {
+			t.Error("expected no Permissions-Policy when it isn't configured")
+		}
+	}
+
+	if nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Errorf("expected a fresh nonce for each request, got %q", nonces)
+	}
+
+	// Reports are truncated in the log and limited by client address
+	var logs strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	report := cspReportLimitMiddleware(cspReportHandler)
+	for i := range cspReportLimit.Burst + 1 {
+		req := httptest.NewRequest("POST", "/csp-report", strings.NewReader(strings.Repeat("x", 32<<10)))
+		w := httptest.NewRecorder()
+		report(w, req)
+		if i < cspReportLimit.Burst && w.Code != http.StatusNoContent {
+			t.Fatalf("report %d: expected status %d, got %d", i, http.StatusNoContent, w.Code)
+		}
+		if i == cspReportLimit.Burst && w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status %d past the limit, got %d", http.StatusTooManyRequests, w.Code)
+		}
+	}
+	if strings.Contains(logs.String(), strings.Repeat("x", maxLoggedCSPReport+1)) || !strings.Contains(logs.String(), "truncated=true") {
+		t.Error("expected reports to be truncated in the log")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	cfg := corsConfig{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Content-Type"},
+		AllowCredentials: true,
+		MaxAge:           duration(time.Minute),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/posts", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /api/v1/posts", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("DELETE /api/v1/posts/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := corsMiddleware(func() corsConfig { return cfg }, mux, mux)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		origin string
+		status int
+		allow  string
+	}{
+		{"preflight", "POST", "/api/v1/posts", "https://app.example.com", http.StatusNoContent, "https://app.example.com"},
+		{"preflight from other origin", "POST", "/api/v1/posts", "https://evil.example", http.StatusForbidden, ""},
+		{"preflight for method not allowed", "DELETE", "/api/v1/posts/1", "https://app.example.com", http.StatusForbidden, ""},
+		{"preflight for unknown route", "POST", "/api/v1/unknown", "https://app.example.com", http.StatusNotFound, ""},
+	} {
+		req := httptest.NewRequest("OPTIONS", tc.path, nil)
+		req.Header.Set("Origin", tc.origin)
+		req.Header.Set("Access-Control-Request-Method", tc.method)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+		if allow := w.Header().Get("Access-Control-Allow-Origin"); allow != tc.allow {
+			t.Errorf("%s: expected allowed origin %q, got %q", tc.name, tc.allow, allow)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/posts", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("expected CORS headers on the response, got %v", w.Header())
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	app := &application{enabledModules: map[string]bool{}}
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+		error  string
+	}{
+		{"valid", `{"author": "Frodo", "message": "Hi"}`, http.StatusCreated, ""},
+		{"empty", ``, http.StatusBadRequest, "Request body must not be empty"},
+		{"malformed", `{"author": "Frodo",}`, http.StatusBadRequest, "Request body contains malformed JSON at position 20"},
+		{"truncated", `{"author": "Frodo"`, http.StatusBadRequest, "Request body contains malformed JSON"},
+		{"wrong type", `{"author": 42, "message": "Hi"}`, http.StatusBadRequest, "Field author must be a string"},
+		{"not an object", `["Frodo"]`, http.StatusBadRequest, "Request body must be a JSON object"},
+		{"unknown field", `{"author": "Frodo", "message": "Hi", "admin": true}`, http.StatusBadRequest, "Unknown field admin"},
+		{"trailing data", `{"author": "Frodo", "message": "Hi"} {}`, http.StatusBadRequest, "Request body must contain a single JSON object"},
+		{"author too long", fmt.Sprintf(`{"author": %q, "message": "Hi"}`, strings.Repeat("é", maxAuthorLength+1)), http.StatusBadRequest, "Field author must be at most 100 characters long"},
+		{"too large", fmt.Sprintf(`{"author": "Frodo", "message": %q}`, strings.Repeat("a", maxRequestBodyBytes)), http.StatusRequestEntityTooLarge, "Request body must not be larger than 1048576 bytes"},
+	} {
+		req := httptest.NewRequest("POST", "/api/v1/posts", strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		app.createPost(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+		if tc.error == "" {
+			continue
+		}
+		var p problem
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatalf("%s: failed to decode problem: %v", tc.name, err)
+		}
+		if p.Detail != tc.error {
+			t.Errorf("%s: expected error %q, got %q", tc.name, tc.error, p.Detail)
+		}
+	}
+}
+
+func TestProblem(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/posts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeRequestError(w, r, fieldError("author", "Missing field: author"))
+	})
+	mux.HandleFunc("DELETE /api/v1/posts/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/", notFoundHandler(mux))
+	handler := requestIDMiddleware(mux)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{"GET", "/api/v1/posts/1", http.StatusBadRequest, ""},
+		{"PUT", "/api/v1/posts/1", http.StatusMethodNotAllowed, "GET, HEAD, DELETE"},
+		{"GET", "/api/v1/unknown", http.StatusNotFound, ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("X-Request-ID", "req-1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tc.status || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s: expected status %d and Allow %q, got %d and %q", tc.method, tc.path, tc.status, tc.allow, w.Code, w.Header().Get("Allow"))
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s %s: expected problem details, got %s", tc.method, tc.path, ct)
+		}
+
+		var p problem
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatalf("failed to decode problem: %v", err)
+		}
+		if p.Status != tc.status || p.Instance != tc.path || p.RequestID != "req-1" {
+			t.Errorf("%s %s: unexpected problem %+v", tc.method, tc.path, p)
+		}
+		if tc.status == http.StatusBadRequest && (len(p.Errors) != 1 || p.Errors[0].Pointer != "#/author") {
+			t.Errorf("expected an error for #/author, got %+v", p.Errors)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/unknown", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || w.Header().Get("X-Request-ID") == "" {
+		t.Errorf("expected a plain text error with a request ID for browsers, got %v", w.Header())
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	app := &application{enabledModules: map[string]bool{}}
+
+	for _, tc := range []struct {
+		accept      string
+		status      int
+		contentType string
+		prefix      string
+	}{
+		{"", http.StatusOK, "application/json", `{"id":1,`},
+		{"text/csv", http.StatusOK, "text/csv; charset=utf-8", "id,author,message,owner\n1,Obi-Wan Kenobi,Hello there!,"},
+		{"application/xml;q=0.9, application/yaml", http.StatusOK, "application/yaml", "author: Obi-Wan Kenobi"},
+		{"text/*", http.StatusOK, "text/csv; charset=utf-8", "id,"},
+		{"application/*;q=0.5, application/xml", http.StatusOK, "application/xml; charset=utf-8", xml.Header + "<post><id>1</id>"},
+		{"application/msgpack", http.StatusOK, "application/msgpack", "\x83\xa2id"},
+		{"*/*;q=0.1, application/json;q=0", http.StatusOK, "text/csv; charset=utf-8", "id,"},
+		{"*/*", http.StatusOK, "application/json", `{"id":1,`},
+		{"application/*", http.StatusOK, "application/json", `{"id":1,`},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", http.StatusOK, "application/json", `{"id":1,`},
+		{"image/png", http.StatusNotAcceptable, "application/problem+json", `{"type":"about:blank"`},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/posts/1", nil)
+		req.SetPathValue("id", "1")
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		app.getPost(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("%q: expected status %d, got %d", tc.accept, tc.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != tc.contentType {
+			t.Errorf("%q: expected Content-Type %q, got %q", tc.accept, tc.contentType, ct)
+		}
+		if !strings.HasPrefix(w.Body.String(), tc.prefix) {
+			t.Errorf("%q: expected body to start with %q, got %q", tc.accept, tc.prefix, w.Body.String())
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("%q: expected Vary: Accept", tc.accept)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/posts", nil)
+	req.Header.Set("Accept", "application/xml")
+	w := httptest.NewRecorder()
+	app.getPosts(w, req)
+	if !strings.HasPrefix(w.Body.String(), xml.Header+"<posts><post>") {
+		t.Errorf("expected a posts document, got %q", w.Body.String())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat(`{"author": "Frodo", "message": "Hi"}`, 100)
+	handler := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, large)
+		case "/small":
+			io.WriteString(w, "ok")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		case "/stream":
+			io.WriteString(w, "first")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, "second")
+		}
+	}))
+
+	for _, tc := range []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"/large", "gzip, deflate", "gzip"},
+		{"/large", "gzip;q=0.5, br", "br"},
+		{"/large", "zstd, br, gzip", "zstd"},
+		{"/large", "zstd", "zstd"},
+		{"/large", "identity", ""},
+		{"/small", "gzip", ""},
+		{"/image", "gzip", ""},
+		{"/stream", "gzip", "gzip"},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if encoding := w.Header().Get("Content-Encoding"); encoding != tc.encoding {
+			t.Errorf("%s with %q: expected encoding %q, got %q", tc.path, tc.acceptEncoding, tc.encoding, encoding)
+			continue
+		}
+		if tc.encoding == "gzip" {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s: failed to read gzip: %v", tc.path, err)
+			}
+			body, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%s: failed to decompress: %v", tc.path, err)
+			}
+			if expected := map[string]string{"/large": large, "/stream": "firstsecond"}[tc.path]; string(body) != expected {
+				t.Errorf("%s: unexpected body %q", tc.path, body)
+			}
+		}
+		if tc.path == "/stream" && !w.Flushed {
+			t.Error("expected the stream to be flushed")
+		}
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0o600)
+	os.WriteFile(filepath.Join(dir, "app.js.br"), []byte("brotli"), 0o600)
+	fileServer := precompressedFileServer(dir)
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"gzip, br", "br", "brotli"},
+		{"gzip", "", "console.log(1)"},
+	} {
+		req := httptest.NewRequest("GET", "/app.js", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		w := httptest.NewRecorder()
+		fileServer.ServeHTTP(w, req)
+
+		if w.Header().Get("Content-Encoding") != tc.encoding || w.Body.String() != tc.body {
+			t.Errorf("%q: expected %q encoded %q, got %q encoded %q", tc.acceptEncoding, tc.body, tc.encoding, w.Body.String(), w.Header().Get("Content-Encoding"))
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+			t.Errorf("%q: expected JavaScript, got %q", tc.acceptEncoding, ct)
+		}
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var buf strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/posts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r).Info("Handling")
+		w.Write([]byte("hello"))
+	})
+	handler := requestIDMiddleware(requestLoggerMiddleware(nil, recordRoute(mux)))
+
+	req := httptest.NewRequest("GET", "/api/v1/posts/1", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Request-ID") != "req-1" {
+		t.Errorf("expected the request ID to be echoed, got %q", w.Header().Get("X-Request-ID"))
+	}
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("failed to parse log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 log records, got %d", len(records))
+	}
+	for _, record := range records {
+		if record["request_id"] != "req-1" {
+			t.Errorf("expected request ID in %v", record)
+		}
+	}
+	access := records[1]
+	if access["route"] != "GET /api/v1/posts/{id}" || access["status"] != 200.0 || access["bytes"] != 5.0 || access["latency"] == nil {
+		t.Errorf("unexpected request record %v", access)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if id := w.Header().Get("X-Request-ID"); id == "" || id == "bad id\n" {
+		t.Errorf("expected a generated request ID, got %q", id)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "logs", "access.log")
+
+	accessLog, err := newAccessLogger(accessLogConfig{File: file, Format: "combined"})
+	if err != nil {
+		t.Fatalf("failed to open access log: %v", err)
+	}
+	defer accessLog.out.Close()
+
+	var logs strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	handler := requestLoggerMiddleware(accessLog, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logInfoFromContext(r.Context()).user = "alice"
+		w.Write([]byte("hello"))
+	}))
+
+	// The address forwarded by nginx is only trusted from nginx
+	defer func(proxies []netip.Prefix) { trustedProxies = proxies }(trustedProxies)
+	trustedProxies, _ = parseTrustedProxies([]string{"192.0.2.0/24"})
+	spoofed := httptest.NewRequest("GET", "/", nil)
+	spoofed.RemoteAddr = "198.51.100.1:1234"
+	spoofed.Header.Set("X-Client-IP", "203.0.113.7")
+	if ip := clientIP(spoofed); ip != "198.51.100.1" {
+		t.Errorf("expected the header of an untrusted peer to be ignored, got %q", ip)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/posts?page=2", nil)
+	req.Header.Set("X-Client-IP", "203.0.113.7")
+	req.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read access log: %v", err)
+	}
+	line := strings.TrimSpace(string(data))
+	prefix := `203.0.113.7 - alice [`
+	suffix := `] "GET /api/v1/posts?page=2 HTTP/1.1" 200 5 "-" "curl/8.0 \"quoted\""`
+	if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, suffix) {
+		t.Errorf("unexpected access log line %q", line)
+	}
+	if !strings.Contains(logs.String(), "msg=Request") || !strings.Contains(logs.String(), "user=alice") {
+		t.Errorf("expected the request in the application log too, got %q", logs.String())
+	}
+
+	// Reopen after logrotate moved the file
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := accessLog.out.reopen(); err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if data, _ := os.ReadFile(file); !strings.HasPrefix(string(data), prefix) {
+		t.Errorf("expected a new line in the reopened file, got %q", data)
+	}
+
+	// Rotate on every write, keeping one compressed backup. Other files
+	// next to the log aren't backups
+	other := filepath.Join(dir, "logs", "access-notes.log")
+	if err := os.WriteFile(other, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rotating, err := openRotatingFile(accessLogConfig{File: file, MaxAge: duration(time.Nanosecond), MaxBackups: 1, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		rotating.Write([]byte("line\n"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := rotating.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "logs", "access-2*"))
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".log.gz") {
+		t.Errorf("expected one compressed backup, got %v", backups)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected other files to be kept: %v", err)
+	}
+
+	// A file that failed to open is opened again by the next write
+	failing, err := openRotatingFile(accessLogConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer failing.Close()
+	os.Remove(file)
+	if err := os.Mkdir(file, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := failing.reopen(); err == nil {
+		t.Fatal("expected reopening in place of a directory to fail")
+	}
+	if _, err := failing.Write([]byte("lost\n")); err == nil {
+		t.Error("expected the write to fail while the file can't be opened")
+	}
+	os.Remove(file)
+	if _, err := failing.Write([]byte("line\n")); err != nil {
+		t.Errorf("expected the file to be opened again: %v", err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "line\n" {
+		t.Errorf("expected the line in the new file, got %q", data)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	app := &application{enabledModules: map[string]bool{}, metrics: newHTTPMetrics()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/posts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	mux.HandleFunc("/", notFoundHandler(mux))
+	handler := requestLoggerMiddleware(nil, app.metrics.middleware(recordRoute(mux)))
+
+	for _, path := range []string{"/api/v1/posts/1", "/api/v1/posts/2", "/unknown"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	for _, method := range []string{"FOO", "BAR"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/unknown", nil))
+	}
+
+	w := httptest.NewRecorder()
+	app.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		`http_requests_total{route="GET /api/v1/posts/{id}",method="GET",status="200"} 2`,
+		`http_requests_total{route="unmatched",method="GET",status="404"} 1`,
+		`http_request_duration_seconds_bucket{route="GET /api/v1/posts/{id}",method="GET",le="+Inf"} 2`,
+		`http_request_duration_seconds_count{route="unmatched",method="GET"} 1`,
+		`http_request_duration_seconds_count{route="unmatched",method="other"} 2`,
+		"http_requests_in_flight 0",
+		fmt.Sprintf("posts %d", len(posts)),
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in metrics:\n%s", line, body)
+		}
+	}
+
+	// On the main port, the metrics aren't public
+	app.enabledModules["auth"] = true
+	mux = http.NewServeMux()
+	app.handle(mux, "GET /metrics", app.metricsHandler)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous scrapes to get status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/posts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		ctx := queryTracer{}.TraceQueryStart(r.Context(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+		queryTracer{}.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	handler := requestLoggerMiddleware(nil, tracingMiddleware(recordRoute(mux)))
+
+	req := httptest.NewRequest("GET", "/api/v1/posts/1", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	query, server := spans[0], spans[1]
+
+	if server.Name() != "GET /api/v1/posts/{id}" {
+		t.Errorf("unexpected span name %q", server.Name())
+	}
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected the span to continue the trace of the traceparent header")
+	}
+	if server.Status().Code != codes.Error {
+		t.Errorf("expected an error status, got %v", server.Status().Code)
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, attr := range server.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	if attrs["http.route"].AsString() != "GET /api/v1/posts/{id}" || attrs["http.response.status_code"].AsInt64() != 500 {
+		t.Errorf("unexpected span attributes %v", attrs)
+	}
+
+	if query.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("expected the query span to be a child of the request span")
+	}
+}
+
+func TestDebug(t *testing.T) {
+	handler := debugHandler()
+	for path, want := range map[string]string{
+		"/debug/vars":       `"memstats":`,
+		"/debug/goroutines": "goroutine ",
+		"/debug/pprof/":     "heap",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: expected 200 with %q, got %d", path, want, w.Code)
+		}
+	}
+
+	for addr, want := range map[string]bool{
+		"127.0.0.1:6060": true,
+		"[::1]:6060":     true,
+		"localhost:6060": true,
+		":6060":          false,
+		"0.0.0.0:6060":   false,
+		"10.0.0.1:6060":  false,
+	} {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+
+	dir := t.TempDir()
+	p, err := newProfiler(profilingConfig{Dir: dir, Interval: duration(time.Minute), CPUDuration: duration(time.Second), MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("failed to create profiler: %v", err)
+	}
+	for _, name := range []string{"heap-1.pprof", "heap-2.pprof", "heap-3.pprof"} {
+		if err := p.writeHeapProfile(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("failed to write heap profile: %v", err)
+		}
+	}
+	p.prune("heap-*.pprof")
+	files, _ := filepath.Glob(filepath.Join(dir, "heap-*.pprof"))
+	if len(files) != 2 || filepath.Base(files[0]) != "heap-2.pprof" {
+		t.Errorf("expected the 2 latest profiles to be kept, got %v", files)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	var calls int
+	registry := newHealthRegistry(time.Minute, time.Second)
+	registry.add("ok", func(ctx context.Context) error { return nil })
+	registry.add("broken", func(ctx context.Context) error {
+		calls++
+		return errors.New("connection refused")
+	})
+
+	probe := func(target string) (int, healthResponse) {
+		w := httptest.NewRecorder()
+		registry.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		var resp healthResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("failed to decode %s: %v", target, err)
+		}
+		return w.Code, resp
+	}
+
+	code, resp := probe("/readyz")
+	if code != http.StatusServiceUnavailable || resp.Status != "failed" || len(resp.Checks) != 2 {
+		t.Errorf("expected a failed probe with 2 checks, got %d %+v", code, resp)
+	}
+	if resp.Checks[1].LatencyMS != nil {
+		t.Errorf("expected no details without verbose, got %+v", resp.Checks[1])
+	}
+
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, httptest.NewRequest("GET", "/readyz?verbose", nil))
+	if strings.Contains(w.Body.String(), "connection refused") {
+		t.Errorf("expected errors to be kept out of the response, got %s", w.Body)
+	}
+	code, resp = probe("/readyz?verbose")
+	if code != http.StatusServiceUnavailable || resp.Checks[1].LatencyMS == nil {
+		t.Errorf("expected details with verbose, got %+v", resp.Checks[1])
+	}
+	if calls != 1 {
+		t.Errorf("expected the cached result to be reused, got %d calls", calls)
+	}
+
+	code, resp = probe("/readyz?exclude=broken")
+	if code != http.StatusOK || resp.Status != "ok" || len(resp.Checks) != 1 {
+		t.Errorf("expected the broken check to be excluded, got %d %+v", code, resp)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	coordinator := newShutdownCoordinator()
+	var order []string
+	for _, name := range []string{"database", "access log", "metrics server"} {
+		coordinator.onShutdown(name, func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+
+	coordinator.onShutdown("tracing", func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			t.Errorf("expected the hook to have time left, got %v", err)
+		}
+		return nil
+	})
+
+	coordinator.runHooks(time.Second)
+	if strings.Join(order, ",") != "metrics server,access log,database" {
+		t.Errorf("expected hooks in reverse order of registration, got %v", order)
+	}
+
+	readiness := newHealthRegistry(time.Minute, time.Second)
+	readiness.add("database", func(ctx context.Context) error { return nil })
+	readiness.startDraining()
+
+	w := httptest.NewRecorder()
+	readiness.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"name":"shutdown","status":"failed"`) {
+		t.Errorf("expected readiness to fail while draining, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	os.WriteFile(file, []byte("port: 4000\nmodules: [webui, database]\nlog:\n  level: warn\n  format: json\n"), 0o600)
+	secret := filepath.Join(dir, "database_url")
+	os.WriteFile(secret, []byte("postgres://db/posts\n"), 0o600)
+
+	env := map[string]string{
+		"HTTP_SERVER_CONFIG":    file,
+		"HTTP_SERVER_LOG_LEVEL": "debug",
+		"DATABASE_URL_FILE":     secret,
+	}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	cfg, err := loadConfig([]string{"--log.level", "error", "--access-log.compress=false"}, lookupEnv)
+	if err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+	if cfg.Port != 4000 || cfg.Log.Format != "json" {
+		t.Errorf("expected the file to override the defaults, got %+v", cfg)
+	}
+	if cfg.Log.Level != "error" {
+		t.Errorf("expected flags to override the environment, got %q", cfg.Log.Level)
+	}
+	if cfg.DatabaseURL != "postgres://db/posts" {
+		t.Errorf("expected the database URL from the _FILE variable, got %q", cfg.DatabaseURL)
+	}
+	if cfg.AccessLog.Compress || cfg.AccessLog.MaxBackups != 7 {
+		t.Errorf("unexpected access log configuration %+v", cfg.AccessLog)
+	}
+
+	env["HTTP_SERVER_PORT"] = "http"
+	env["HTTP_SERVER_MODULES"] = "webui, auth, jwt, nope"
+	_, err = loadConfig(nil, lookupEnv)
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) {
+		t.Fatalf("expected joined errors, got %v", err)
+	}
+	for _, want := range []string{"HTTP_SERVER_PORT", `unknown module "nope"`, "auth.username", "auth.password"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected an error about %s, got:\n%v", want, err)
+		}
+	}
+
+	if _, err := loadConfig([]string{"--config", filepath.Join(dir, "missing.yaml")}, lookupEnv); err == nil {
+		t.Error("expected an error for a missing configuration file")
+	}
+	if _, err := loadConfig([]string{"--auth.password", "secret"}, lookupEnv); err == nil {
+		t.Error("expected secrets not to be settable with flags")
+	}
+	if _, err := loadConfig([]string{"--auth.reload-interval", "-1s"}, lookupEnv); err == nil || !strings.Contains(err.Error(), "auth.reload_interval") {
+		t.Errorf("expected a negative htpasswd reload interval to be rejected, got %v", err)
+	}
+
+	// Compose passes variables that aren't set on the host as empty
+	password := filepath.Join(dir, "password")
+	os.WriteFile(password, []byte("secret\n"), 0o600)
+	env = map[string]string{
+		"HTTP_SERVER_CONFIG":  file,
+		"DATABASE_URL":        "",
+		"DATABASE_URL_FILE":   secret,
+		"AUTH_USERNAME":       "",
+		"AUTH_PASSWORD":       "",
+		"AUTH_PASSWORD_FILE":  password,
+		"HTTP_SERVER_MODULES": "",
+	}
+	os.WriteFile(file, []byte("modules: [webui, database, auth]\nauth:\n  username: admin\n"), 0o600)
+	cfg, err = loadConfig(nil, lookupEnv)
+	if err != nil {
+		t.Fatalf("expected empty variables to be ignored: %v", err)
+	}
+	if cfg.Auth.Username != "admin" || cfg.Auth.Password != "secret" || cfg.DatabaseURL != "postgres://db/posts" || len(cfg.Modules) != 3 {
+		t.Errorf("expected the file and _FILE variables to apply, got %+v", cfg)
+	}
+
+	cfg.Modules = []string{"webui", "database", "auth", "jwt", "cors"}
+	cfg.Lockout.Window = 0
+	cfg.CORS.AllowedOrigins = []string{"example.com"}
+	cfg.JWT.SigningKey = "missing"
+	cfg.SecurityHeaders.ReportURI = "/reports"
+	cfg.Modules = append(cfg.Modules, "ratelimit")
+	cfg.RateLimit.Routes = map[string]rateLimit{"POST /api/v1/post": {Requests: 1, Period: duration(time.Minute)}}
+	errs := fmt.Sprint(cfg.validate())
+	for _, want := range []string{"lockout.window", "cors: invalid origin", `jwt: signing key "missing"`, `security_headers.report_uri: invalid URL "/reports"`, `rate_limit.routes: unknown route "POST /api/v1/post"`} {
+		if !strings.Contains(errs, want) {
+			t.Errorf("expected an error about %s, got %s", want, errs)
+		}
+	}
+	cfg.CORS.AllowedOrigins = []string{"*"}
+	cfg.CORS.AllowCredentials = true
+	errs = fmt.Sprint(cfg.validate())
+	for _, want := range []string{`cors: allowed origin "*" can't be combined with allow_credentials`} {
+		if !strings.Contains(errs, want) {
+			t.Errorf("expected an error about %s, got %s", want, errs)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	current := defaultConfig()
+	current.Modules = []string{"webui", "database", "compression", "ratelimit"}
+	next := defaultConfig()
+	next.Modules = []string{"webui", "cors", "ratelimit", "metrics"}
+	next.Port = 4000
+	next.Log.Level = "debug"
+	next.Log.Format = "json"
+	next.RateLimit.Default.Requests = 5
+	next.Server.WriteTimeout = duration(time.Minute)
+	next.Server.IdleTimeout = duration(time.Minute)
+
+	applied, restart := applyConfig(&current, &next)
+
+	for _, want := range []string{"log.level", "modules: enabled cors", "modules: disabled compression", "rate_limit", "server.write_timeout"} {
+		if !slices.Contains(applied, want) {
+			t.Errorf("expected %q to be applied, got %v", want, applied)
+		}
+	}
+	for _, want := range []string{"log.format", "modules: enabled metrics", "modules: disabled database", "port", "server.idle_timeout"} {
+		if !slices.Contains(restart, want) {
+			t.Errorf("expected %q to require a restart, got %v", want, restart)
+		}
+	}
+
+	if next.Port != current.Port || next.Log.Format != current.Log.Format || next.Server.IdleTimeout != current.Server.IdleTimeout {
+		t.Errorf("expected changes requiring a restart to be reverted, got %+v", next)
+	}
+	if next.Log.Level != "debug" || next.RateLimit.Default.Requests != 5 || next.Server.WriteTimeout != duration(time.Minute) {
+		t.Errorf("expected live changes to be kept, got %+v", next)
+	}
+	slices.Sort(next.Modules)
+	if !slices.Equal(next.Modules, []string{"cors", "database", "ratelimit", "webui"}) {
+		t.Errorf("expected only live modules to be toggled, got %v", next.Modules)
+	}
+
+	// Reverted changes are reported again until the restart
+	again := next
+	again.Port = 4000
+	if _, restart := applyConfig(&next, &again); !slices.Equal(restart, []string{"port"}) {
+		t.Errorf("expected the port change to be reported again, got %v", restart)
+	}
+
+	// Rate limits only apply live when the module was enabled at startup
+	current = defaultConfig()
+	next = defaultConfig()
+	next.RateLimit.Default.Requests = 10
+	if applied, restart := applyConfig(&current, &next); len(applied) != 0 || !slices.Equal(restart, []string{"rate_limit"}) {
+		t.Errorf("expected the rate limit change to require a restart, got %v and %v", applied, restart)
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	server := newHTTPServer(defaultConfig().Server, ":3000", http.NotFoundHandler())
+	if server.ReadTimeout != 5*time.Second || server.WriteTimeout != 10*time.Second || server.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("expected the timeouts and limits of the configuration, got %+v", server)
+	}
+
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}
+	noTimeout := duration(0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /slow", slow)
+	mux.HandleFunc("GET /export", routeTimeoutMiddleware(routeTimeoutConfig{WriteTimeout: &noTimeout}, slow))
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.WriteTimeout = 50 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	if _, err := http.Get(ts.URL + "/slow"); err == nil {
+		t.Error("expected the write timeout of the server to cut the response")
+	}
+	resp, err := http.Get(ts.URL + "/export")
+	if err != nil {
+		t.Fatalf("expected the route to override the write timeout: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("expected the complete response, got %q", body)
+	}
+
+	// Reloaded timeouts apply to the following requests
+	cfg := defaultConfig()
+	cfg.Server.WriteTimeout = duration(50 * time.Millisecond)
+	app := &application{}
+	app.config.Store(&cfg)
+	live := httptest.NewServer(app.serverTimeoutMiddleware(http.HandlerFunc(slow)))
+	defer live.Close()
+	if _, err := http.Get(live.URL); err == nil {
+		t.Error("expected the configured write timeout to cut the response")
+	}
+	reloaded := cfg
+	reloaded.Server.WriteTimeout = 0
+	app.config.Store(&reloaded)
+	resp, err = http.Get(live.URL)
+	if err != nil {
+		t.Fatalf("expected the reloaded write timeout to apply: %v", err)
+	}
+	resp.Body.Close()
+
+	invalid := defaultConfig()
+	invalid.Server.WriteTimeout = duration(-time.Second)
+	invalid.Server.Routes = map[string]routeTimeoutConfig{
+		"GET /api/v1/posts":   {ReadTimeout: &invalid.Server.WriteTimeout},
+		"GET /api/v1/exports": {WriteTimeout: &noTimeout},
+	}
+	invalid.Shutdown.Timeout = 0
+	errs := invalid.validate()
+	if len(errs) != 4 || !strings.Contains(fmt.Sprint(errs), `unknown route "GET /api/v1/exports"`) {
+		t.Errorf("expected 4 errors, got %v", errs)
+	}
+	for pattern := range routePolicies {
+		if !slices.Contains(knownRoutes, pattern) {
+			t.Errorf("expected %q to be a known route", pattern)
+		}
+	}
+}
+
+func TestJWTVerification(t *testing.T) {
+	dir := t.TempDir()
+
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte(strings.Repeat("s", 32)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := jwtConfig{
+		Issuer:         "issuer",
+		Audience:       "audience",
+		AccessTokenTTL: duration(time.Minute),
+		Keys: []jwtKeyConfig{
+			{ID: "hs", Algorithm: "HS256", SecretFile: secretFile},
+			{ID: "ed", Algorithm: "EdDSA", PrivateKeyFile: keyFile},
+		},
+	}
+
+	for _, signingKey := range []string{"hs", "ed"} {
+		cfg.SigningKey = signingKey
+		issuer, err := newJWTIssuer(cfg, newMemoryRefreshTokenStore())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := issuer.issueAccessToken("user")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := issuer.verifyAccessToken(token)
+		if err != nil {
+			t.Fatalf("%s: expected token to be valid, got %v", signingKey, err)
+		}
+		if claims.Subject != "user" {
+			t.Errorf("%s: expected subject %q, got %q", signingKey, "user", claims.Subject)
+		}
+
+		tampered := token[:len(token)-4] + "AAAA"
+		if _, err := issuer.verifyAccessToken(tampered); err == nil {
+			t.Errorf("%s: expected tampered token to be rejected", signingKey)
+		}
+
+		other := *issuer
+		other.audience = "other"
+		if _, err := other.verifyAccessToken(token); err == nil {
+			t.Errorf("%s: expected token for another audience to be rejected", signingKey)
+		}
+	}
+
+	// Refresh tokens that expired without being used are removed
+	refreshTokens := newMemoryRefreshTokenStore()
+	ctx := context.Background()
+	refreshTokens.create(ctx, "unused", "user", time.Now().Add(-time.Minute))
+	refreshTokens.create(ctx, "fresh", "user", time.Now().Add(time.Minute))
+	if _, exists := refreshTokens.tokens["unused"]; exists {
+		t.Error("expected expired refresh token to be removed")
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	app := &application{
+		enabledModules: map[string]bool{"auth": true, "apikeys": true},
+		roles:          rolesConfig{Default: roleViewer},
+		apiKeys:        newMemoryAPIKeyStore(),
+	}
+	app.auth.username = "user"
+	app.auth.password = "pass"
+
+	req := httptest.NewRequest("POST", "/api/v1/keys", strings.NewReader(`{"name": "ci", "scopes": ["posts:write"]}`))
+	req.SetBasicAuth("user", "pass")
+	w := httptest.NewRecorder()
+	app.authorize(routePolicies["POST /api/v1/keys"], app.createAPIKey)(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		key     string
+		status  int
+	}{
+		{app.authorize(routePolicies["POST /api/v1/posts"], ok), created.Key, http.StatusOK},
+		{app.authorize(routePolicies["DELETE /api/v1/posts/{id}"], ok), created.Key, http.StatusForbidden},
+		{app.authorize(routePolicies["GET /api/v1/keys"], ok), created.Key, http.StatusForbidden},
+		{app.authorize(routePolicies["POST /api/v1/posts"], ok), "hsk_invalid", http.StatusUnauthorized},
+		{app.authorize(routePolicies["GET /api/v1/posts"], ok), "", http.StatusOK},
+		{app.authorize(routePolicies["GET /api/v1/posts"], ok), created.Key, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.key != "" {
+			req.Header.Set("X-API-Key", tc.key)
+		}
+		w := httptest.NewRecorder()
+		tc.handler(w, req)
+		if w.Code != tc.status {
+			t.Errorf("expected status %d, got %d", tc.status, w.Code)
+		}
+	}
+}
+
+func TestPostOwnership(t *testing.T) {
+	app := &application{
+		enabledModules: map[string]bool{"auth": true},
+		roles: rolesConfig{
+			Default: roleViewer,
+			Users:   map[string]string{"alice": roleAuthor, "bob": roleAuthor},
+		},
+	}
+
+	mux := http.NewServeMux()
+	app.handle(mux, "POST /api/v1/posts", app.createPost)
+	app.handle(mux, "DELETE /api/v1/posts/{id}", app.deletePost)
+
+	// Authenticate with bearer tokens signed by a throwaway HS256 key
+	app.jwt = &jwtIssuer{
+		issuer:         "issuer",
+		audience:       "audience",
+		accessTokenTTL: time.Minute,
+		keys:           map[string]*jwtKey{"k": {id: "k", algorithm: "HS256", secret: []byte(strings.Repeat("s", 32))}},
+	}
+	app.jwt.signingKey = app.jwt.keys["k"]
+
+	do := func(method, target, user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if user != "" {
+			token, err := app.jwt.issueAccessToken(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/api/v1/posts", "carol", `{"author": "Carol", "message": "Hi"}`)
+	if w.Code != http.StatusForbidden || w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("expected viewer to get a %d problem, got %d %q", http.StatusForbidden, w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = do("POST", "/api/v1/posts", "alice", `{"author": "Alice", "message": "Hi"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+	var created post
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/api/v1/posts/%d", created.ID)
+
+	if w := do("DELETE", target, "bob", ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected another author to get status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if w := do("DELETE", target, "alice", ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected the owner to get status %d, got %d", http.StatusNoContent, w.Code)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	app := &application{
+		enabledModules: map[string]bool{"auth": true},
+		roles:          rolesConfig{Default: roleViewer},
+		failures:       newMemoryFailureStore(),
+		lockout: lockoutConfig{
+			FreeAttempts:    2,
+			BaseDelay:       duration(time.Minute),
+			LockoutDuration: duration(time.Hour),
+			Window:          duration(time.Hour),
+		},
+	}
+	app.auth.username = "user"
+	app.auth.password = "pass"
+
+	protected := app.authorize(routePolicies["POST /api/v1/posts"], func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	attempt := func(password, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/posts", nil)
+		req.SetBasicAuth("user", password)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		protected(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := attempt("wrong", "192.0.2.1"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status %d for free attempt, got %d", http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	w := attempt("wrong", "192.0.2.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected status %d with Retry-After 60, got %d %q", http.StatusTooManyRequests, w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// The username is locked, even with the right password and from
+	// another address
+	if w := attempt("pass", "192.0.2.2"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d while locked, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/lockouts/unlock", strings.NewReader(`{"username": "user"}`))
+	w = httptest.NewRecorder()
+	app.unlockHandler(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	if w := attempt("pass", "192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("expected status %d after unlock, got %d", http.StatusOK, w.Code)
+	}
+
+	if d := app.lockout.backoff(10); d != time.Hour {
+		t.Errorf("expected backoff to be capped at %s, got %s", time.Hour, d)
+	}
+
+	// A burst of guesses only gets as many checks as the free attempts,
+	// plus the one that locks
+	store := &countingFailureStore{memoryFailureStore: newMemoryFailureStore()}
+	app.failures = store
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt("wrong", "192.0.2.3")
+		}()
+	}
+	wg.Wait()
+	if n := store.failed.Load(); n > 3 {
+		t.Errorf("expected at most 3 guesses to be checked, got %d", n)
+	}
+}
+
+// countingFailureStore counts the attempts that failed.
+type countingFailureStore struct {
+	*memoryFailureStore
+	failed atomic.Int32
+}
+
+func (s *countingFailureStore) done(ctx context.Context, key string, failed bool) (int, error) {
+	if failed && strings.HasPrefix(key, "user:") {
+		s.failed.Add(1)
+	}
+	return s.memoryFailureStore.done(ctx, key, failed)
+}
+
+func TestRateLimit(t *testing.T) {
+	app := &application{
+		enabledModules: map[string]bool{"ratelimit": true},
+		rateLimiter:    newMemoryRateLimiter(),
+	}
+	app.rateLimits.Store(&rateLimitConfig{
+		Default: rateLimit{Requests: 1, Period: duration(time.Minute), Burst: 2, By: "ip"},
+	})
+
+	mux := http.NewServeMux()
+	app.handle(mux, "GET /api/v1/posts", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	get := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/posts", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, remaining := range []string{"1", "0"} {
+		w := get("192.0.2.1")
+		if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("request %d: expected status %d with %s remaining, got %d with %q", i, http.StatusOK, remaining, w.Code, w.Header().Get("RateLimit-Remaining"))
+		}
+	}
+
+	w := get("192.0.2.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 59 || retryAfter > 60 {
+		t.Errorf("expected Retry-After of about 60 seconds, got %q", w.Header().Get("Retry-After"))
+	}
+
+	if w := get("192.0.2.2"); w.Code != http.StatusOK {
+		t.Errorf("expected another client to get status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// Failed authentication on a route limited by identity is limited by
+	// client address before the credentials are checked
+	app.enabledModules["auth"] = true
+	app.auth.username = "user"
+	app.auth.password = "pass"
+	app.rateLimits.Store(&rateLimitConfig{
+		Default: rateLimit{Requests: 1, Period: duration(time.Minute), Burst: 2, By: "ip"},
+		Routes: map[string]rateLimit{
+			"POST /api/v1/posts": {Requests: 10, Period: duration(time.Minute), Burst: 10, By: "identity"},
+		},
+		PreAuth: rateLimit{Requests: 1, Period: duration(time.Minute), Burst: 2, By: "ip"},
+	})
+	app.handle(mux, "POST /api/v1/posts", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for i, status := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("POST", "/api/v1/posts", nil)
+		req.RemoteAddr = "192.0.2.3:1234"
+		req.SetBasicAuth("user", "wrong")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("request %d: expected status %d, got %d", i, status, w.Code)
+		}
+	}
+
+	// Buckets of the default and pre-authentication limits take the longest
+	// to refill: a burst of 2 at 1 per minute
+	if refill := app.rateLimits.Load().longestRefill(); refill != 2*time.Minute {
+		t.Errorf("expected the longest refill to take %s, got %s", 2*time.Minute, refill)
+	}
+}
+
+// mockOIDCProvider is a minimal OpenID Connect provider, which authorizes
+// every request and signs ID tokens with an RSA key.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newMockOIDCProvider(t *testing.T, claims map[string]any) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockOIDCProvider{key: key, claims: claims, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "PKCE is required", http.StatusBadRequest)
+			return
+		}
+
+		p.mu.Lock()
+		code := fmt.Sprintf("code-%d", len(p.codes))
+		p.codes[code] = query
+		p.mu.Unlock()
+
+		http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		authorization, exists := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !exists || authorization.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]any{
+			"iss":   p.URL,
+			"aud":   authorization.Get("client_id"),
+			"sub":   "1234",
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": authorization.Get("nonce"),
+		}
+		for k, v := range p.claims {
+			claims[k] = v
+		}
+
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "mock"})
+		payload, _ := json.Marshal(claims)
+		signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		hash := sha256.Sum256([]byte(signingInput))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     signingInput + "." + base64.RawURLEncoding.EncodeToString(signature),
+		})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newMockOIDCProvider(t, map[string]any{
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "staff-admins"},
+	})
+
+	oidc, err := newOIDCProvider(context.Background(), oidcConfig{
+		Issuer:        provider.URL,
+		ClientID:      "http-server",
+		RedirectURL:   "https://localhost/login/oidc/callback",
+		Scopes:        []string{"openid"},
+		UsernameClaim: "preferred_username",
+		RolesClaim:    "groups",
+		RoleMapping:   map[string]string{"staff": roleEditor, "staff-admins": roleAdmin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		enabledModules: map[string]bool{"auth": true, "webui": true, "oidc": true},
+		roles:          rolesConfig{Default: roleViewer},
+		sessions:       newMemorySessionStore(),
+		sessionConfig:  sessionConfig{IdleTimeout: duration(time.Minute), AbsoluteTimeout: duration(time.Hour)},
+		oidc:           oidc,
+	}
+
+	// Start the login and follow the redirect to the provider, which
+	// redirects back to the callback
+	w := httptest.NewRecorder()
+	app.oidcLoginHandler(w, httptest.NewRequest("GET", "/login/oidc", nil))
+	stateCookie := w.Result().Cookies()[0]
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	callback := res.Header.Get("Location")
+
+	req := httptest.NewRequest("GET", callback, nil)
+	w = httptest.NewRecorder()
+	app.oidcCallbackHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected callback without state cookie to get status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	req = httptest.NewRequest("GET", callback, nil)
+	req.AddCookie(stateCookie)
+	w = httptest.NewRecorder()
+	app.oidcCallbackHandler(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body)
+	}
+
+	var sessionCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			sessionCookie = cookie
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("expected a session cookie")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(sessionCookie)
+	p, err := app.authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.name != "oidc:"+provider.URL+"|1234" || p.role != roleAdmin {
+		t.Errorf("expected the subject of the provider to be an admin, got %q with role %q", p.name, p.role)
+	}
+	if user := app.sessionUser(req); user != "alice" {
+		t.Errorf("expected alice to be displayed, got %q", user)
+	}
+}
+
+func TestOIDCLoginDoesNotMatchLocalUsers(t *testing.T) {
+	provider := newMockOIDCProvider(t, map[string]any{"preferred_username": "admin"})
+
+	oidc, err := newOIDCProvider(context.Background(), oidcConfig{
+		Issuer:        provider.URL,
+		ClientID:      "http-server",
+		RedirectURL:   "https://localhost/login/oidc/callback",
+		Scopes:        []string{"openid"},
+		UsernameClaim: "preferred_username",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		enabledModules: map[string]bool{"auth": true, "webui": true, "oidc": true},
+		roles:          rolesConfig{Default: roleViewer, Users: map[string]string{"admin": roleAdmin}},
+		sessions:       newMemorySessionStore(),
+		sessionConfig:  sessionConfig{IdleTimeout: duration(time.Minute), AbsoluteTimeout: duration(time.Hour)},
+		oidc:           oidc,
+	}
+	app.auth.username = "admin"
+
+	w := httptest.NewRecorder()
+	app.oidcLoginHandler(w, httptest.NewRequest("GET", "/login/oidc", nil))
+	stateCookie := w.Result().Cookies()[0]
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	req := httptest.NewRequest("GET", res.Header.Get("Location"), nil)
+	req.AddCookie(stateCookie)
+	w = httptest.NewRecorder()
+	app.oidcCallbackHandler(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusSeeOther, w.Code, w.Body)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	p, err := app.authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.name == "admin" || p.role != roleViewer || p.can(scopeKeysManage) {
+		t.Errorf("expected a viewer distinct from the local admin, got %q with role %q", p.name, p.role)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), principalContextKey{}, p))
+	if postOwner(req) == "admin" {
+		t.Error("expected posts not to be owned by the local admin")
+	}
+
+	// Display names of any length fit in the session
+	idp := &oidcProvider{issuer: "https://idp.example", cfg: oidcConfig{UsernameClaim: "preferred_username"}}
+	_, displayName, _, err := idp.mapClaims(map[string]any{"sub": "1234", "preferred_username": strings.Repeat("é", 500)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if displayName != strings.Repeat("é", maxDisplayNameLength) {
+		t.Errorf("expected the display name to be truncated to %d characters, got %d", maxDisplayNameLength, len([]rune(displayName)))
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	content := "# users\n" +
+		"bcrypt:" + string(bcryptHash) + "\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"apr1:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := loadHtpasswdFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"bcrypt", "sha", "apr1"} {
+		if !f.verify(username, "secret") {
+			t.Errorf("expected password of %s to match", username)
+		}
+		if f.verify(username, "wrong") {
+			t.Errorf("expected wrong password of %s not to match", username)
+		}
+	}
+	if f.verify("unknown", "secret") {
+		t.Error("expected unknown user not to match")
+	}
+
+	if err := os.WriteFile(path, []byte("sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if f.verify("bcrypt", "secret") {
+		t.Error("expected removed user not to match after reload")
+	}
+
+	if err := os.WriteFile(path, []byte("plain:secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.reload(); err == nil {
+		t.Error("expected plaintext password to be rejected")
+	}
+	if !f.verify("sha", "secret") {
+		t.Error("expected previous users to be kept when reload fails")
+	}
+}
+
 // func TestHTTPSRedirectMiddleware(t *testing.T) {
 // 	handler := httpsRedirectMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 // 		w.WriteHeader(http.StatusOK)
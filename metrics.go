@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scopeMetricsRead allows scraping the metrics when they're served by the
+// main server. It can be granted to the API key of a scraper.
+const scopeMetricsRead = "metrics:read"
+
+// latencyBuckets are the upper bounds of the request latency histogram, in
+// seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// standardMethods are the methods used as labels, other methods are counted
+// as "other".
+var standardMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+type requestKey struct {
+	route  string
+	method string
+	status int
+}
+
+type latencyKey struct {
+	route  string
+	method string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// httpMetrics counts the requests by route pattern rather than path, so that
+// post IDs don't multiply the series.
+type httpMetrics struct {
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[latencyKey]*histogram
+}
+
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  map[requestKey]uint64{},
+		latencies: map[latencyKey]*histogram{},
+	}
+}
+
+// middleware records the requests. It must be wrapped by
+// requestLoggerMiddleware, which collects the route pattern.
+func (m *httpMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+
+		rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		if info := logInfoFromContext(r.Context()); info != nil && info.pattern != "" && info.pattern != "/" {
+			route = info.pattern
+		}
+
+		// Clients may send any method, only the standard ones get their own
+		// series
+		method := "other"
+		if slices.Contains(standardMethods, r.Method) {
+			method = r.Method
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.requests[requestKey{route, method, rec.statusCode}]++
+		key := latencyKey{route, method}
+		h, exists := m.latencies[key]
+		if !exists {
+			h = &histogram{}
+			m.latencies[key] = h
+		}
+		h.observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a sample, labels being name and value pairs.
+func (mw metricsWriter) sample(name string, value float64, labels ...string) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, "%s=\"%s\"", labels[i], labelValueEscaper.Replace(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	mw.w.WriteByte(' ')
+	mw.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	mw.w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *httpMetrics) write(mw metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	slices.SortFunc(requestKeys, func(a, b requestKey) int {
+		return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.method, b.method), cmp.Compare(a.status, b.status))
+	})
+
+	mw.header("http_requests_total", "counter", "Requests by route pattern, method and status.")
+	for _, key := range requestKeys {
+		mw.sample("http_requests_total", float64(m.requests[key]), "route", key.route, "method", key.method, "status", strconv.Itoa(key.status))
+	}
+
+	latencyKeys := make([]latencyKey, 0, len(m.latencies))
+	for key := range m.latencies {
+		latencyKeys = append(latencyKeys, key)
+	}
+	slices.SortFunc(latencyKeys, func(a, b latencyKey) int {
+		return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.method, b.method))
+	})
+
+	mw.header("http_request_duration_seconds", "histogram", "Request latencies by route pattern and method.")
+	for _, key := range latencyKeys {
+		h := m.latencies[key]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			mw.sample("http_request_duration_seconds_bucket", float64(cumulative), "route", key.route, "method", key.method, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		mw.sample("http_request_duration_seconds_bucket", float64(h.count), "route", key.route, "method", key.method, "le", "+Inf")
+		mw.sample("http_request_duration_seconds_sum", h.sum, "route", key.route, "method", key.method)
+		mw.sample("http_request_duration_seconds_count", float64(h.count), "route", key.route, "method", key.method)
+	}
+
+	mw.header("http_requests_in_flight", "gauge", "Requests being handled.")
+	mw.sample("http_requests_in_flight", float64(m.inFlight.Load()))
+}
+
+// runtimeMetrics maps runtime/metrics samples to metric names.
+var runtimeMetrics = []struct {
+	name, kind, help, sample string
+}{
+	{"go_goroutines", "gauge", "Number of goroutines.", "/sched/goroutines:goroutines"},
+	{"go_memory_total_bytes", "gauge", "Memory mapped by the Go runtime.", "/memory/classes/total:bytes"},
+	{"go_heap_objects_bytes", "gauge", "Memory occupied by live and unswept heap objects.", "/memory/classes/heap/objects:bytes"},
+	{"go_heap_allocs_bytes_total", "counter", "Cumulative bytes allocated on the heap.", "/gc/heap/allocs:bytes"},
+	{"go_gc_cycles_total", "counter", "Completed GC cycles.", "/gc/cycles/total:gc-cycles"},
+	{"go_gc_goal_bytes", "gauge", "Heap size target of the current GC cycle.", "/gc/heap/goal:bytes"},
+}
+
+func writeRuntimeMetrics(mw metricsWriter) {
+	samples := make([]metrics.Sample, len(runtimeMetrics))
+	for i, m := range runtimeMetrics {
+		samples[i].Name = m.sample
+	}
+	metrics.Read(samples)
+
+	for i, m := range runtimeMetrics {
+		var value float64
+		switch samples[i].Value.Kind() {
+		case metrics.KindUint64:
+			value = float64(samples[i].Value.Uint64())
+		case metrics.KindFloat64:
+			value = samples[i].Value.Float64()
+		default:
+			continue
+		}
+		mw.header(m.name, m.kind, m.help)
+		mw.sample(m.name, value)
+	}
+
+	mw.header("go_info", "gauge", "Version of Go the server was built with.")
+	mw.sample("go_info", 1, "version", runtime.Version())
+}
+
+func (app *application) writeDatabaseMetrics(mw metricsWriter) {
+	if app.db == nil {
+		return
+	}
+	stat := app.db.Stat()
+
+	mw.header("pgxpool_acquired_conns", "gauge", "Connections currently in use.")
+	mw.sample("pgxpool_acquired_conns", float64(stat.AcquiredConns()))
+	mw.header("pgxpool_idle_conns", "gauge", "Idle connections.")
+	mw.sample("pgxpool_idle_conns", float64(stat.IdleConns()))
+	mw.header("pgxpool_total_conns", "gauge", "Open connections.")
+	mw.sample("pgxpool_total_conns", float64(stat.TotalConns()))
+	mw.header("pgxpool_max_conns", "gauge", "Maximum size of the pool.")
+	mw.sample("pgxpool_max_conns", float64(stat.MaxConns()))
+	mw.header("pgxpool_acquires_total", "counter", "Connections acquired from the pool.")
+	mw.sample("pgxpool_acquires_total", float64(stat.AcquireCount()))
+	mw.header("pgxpool_empty_acquires_total", "counter", "Acquires that waited for a connection because the pool was empty.")
+	mw.sample("pgxpool_empty_acquires_total", float64(stat.EmptyAcquireCount()))
+	mw.header("pgxpool_canceled_acquires_total", "counter", "Acquires canceled while waiting.")
+	mw.sample("pgxpool_canceled_acquires_total", float64(stat.CanceledAcquireCount()))
+	mw.header("pgxpool_acquire_duration_seconds_total", "counter", "Time spent acquiring connections, including waiting.")
+	mw.sample("pgxpool_acquire_duration_seconds_total", stat.AcquireDuration().Seconds())
+}
+
+func (app *application) countPosts(ctx context.Context) (int, error) {
+	if !app.enabledModules["database"] {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(posts), nil
+	}
+
+	var count int
+	err := app.db.QueryRow(ctx, "SELECT count(*) FROM posts").Scan(&count)
+	return count, err
+}
+
+// metricsHandler serves the metrics in the Prometheus text exposition format.
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	mw := metricsWriter{bw}
+
+	app.metrics.write(mw)
+	app.writeDatabaseMetrics(mw)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if count, err := app.countPosts(ctx); err != nil {
+		requestLogger(r).Error("Failed to count posts", "error", err)
+	} else {
+		mw.header("posts", "gauge", "Number of posts.")
+		mw.sample("posts", float64(count))
+	}
+
+	writeRuntimeMetrics(mw)
+
+	if err := bw.Flush(); err != nil {
+		requestLogger(r).Error("Failed to write metrics", "error", err)
+	}
+}
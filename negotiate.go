@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"sigs.k8s.io/yaml"
+)
+
+// encoder writes response bodies in a media type. The first of mediaTypes is
+// sent as the Content-Type, the others are accepted aliases.
+type encoder struct {
+	mediaTypes []string
+	encode     func(w io.Writer, v any) error
+}
+
+// encoders are the representations getPosts and getPost can respond with,
+// in order of preference when the client accepts several equally.
+var encoders = []encoder{
+	{[]string{"application/json"}, encodeJSON},
+	{[]string{"text/csv"}, encodeCSV},
+	{[]string{"application/xml", "text/xml"}, encodeXML},
+	{[]string{"application/yaml", "application/x-yaml", "text/yaml"}, encodeYAML},
+	{[]string{"application/msgpack", "application/vnd.msgpack", "application/x-msgpack"}, encodeMsgpack},
+}
+
+func encodeJSON(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// csvMarshaler is implemented by values that can be written as CSV records,
+// the first record being the header.
+type csvMarshaler interface {
+	MarshalCSV() ([][]string, error)
+}
+
+func encodeCSV(w io.Writer, v any) error {
+	m, ok := v.(csvMarshaler)
+	if !ok {
+		return fmt.Errorf("%T can't be encoded as CSV", v)
+	}
+	records, err := m.MarshalCSV()
+	if err != nil {
+		return err
+	}
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+func encodeXML(w io.Writer, v any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+func encodeYAML(w io.Writer, v any) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func encodeMsgpack(w io.Writer, v any) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	return enc.Encode(v)
+}
+
+// negotiate picks the encoder for the Accept header of the request, by the
+// highest quality of the most specific matching media range, JSON winning
+// ties. Requests without an Accept header get JSON, and so do browsers,
+// which ask for HTML and XML for pages.
+func negotiate(r *http.Request) (encoder, bool) {
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return encoders[0], true
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, value := range accept {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, exists := params["q"]; exists {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+
+	// quality returns the quality of the media type given by the most
+	// specific range matching it
+	quality := func(mediaType string) float64 {
+		q, specificity := 0.0, -1
+		for _, rng := range ranges {
+			s := -1
+			switch {
+			case rng.mediaType == mediaType:
+				s = 2
+			case strings.HasSuffix(rng.mediaType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(rng.mediaType, "*")):
+				s = 1
+			case rng.mediaType == "*/*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = rng.q, s
+			}
+		}
+		return q
+	}
+
+	// The default Accept header of browsers prefers XML to */*, which isn't
+	// meant for APIs
+	for _, rng := range ranges {
+		if rng.mediaType == "text/html" && rng.q > 0 && quality(encoders[0].mediaTypes[0]) > 0 {
+			return encoders[0], true
+		}
+	}
+
+	var best encoder
+	bestQ := 0.0
+	for _, enc := range encoders {
+		for _, mediaType := range enc.mediaTypes {
+			if q := quality(mediaType); q > bestQ {
+				best, bestQ = enc, q
+			}
+		}
+	}
+	return best, bestQ > 0
+}
+
+// writeNegotiated responds with v in the representation the client prefers,
+// or 406 when it accepts none of them.
+func writeNegotiated(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Add("Vary", "Accept")
+
+	enc, ok := negotiate(r)
+	if !ok {
+		types := []string{}
+		for _, enc := range encoders {
+			types = append(types, enc.mediaTypes[0])
+		}
+		writeProblem(w, r, http.StatusNotAcceptable, "Supported media types are "+strings.Join(types, ", "))
+		return
+	}
+
+	// Encode before writing anything, so that a failure can still be
+	// reported with a proper status
+	var buf bytes.Buffer
+	_, span := tracer.Start(r.Context(), "encode "+enc.mediaTypes[0])
+	err := enc.encode(&buf, v)
+	span.End()
+	if err != nil {
+		requestLogger(r).Error("Failed to encode response", "media_type", enc.mediaTypes[0], "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	contentType := enc.mediaTypes[0]
+	if strings.HasPrefix(contentType, "text/") || contentType == "application/xml" {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := buf.WriteTo(w); err != nil {
+		requestLogger(r).Error("Failed to write response", "error", err)
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const oidcStateCookieName = "oidc_state"
+
+// oidcRolePriority is used to pick a single role when the claims of a user
+// map to several of them.
+var oidcRolePriority = []string{roleAdmin, roleEditor, roleAuthor, roleViewer}
+
+type oidcProvider struct {
+	cfg          oidcConfig
+	clientSecret string
+	client       *http.Client
+
+	issuer                string
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+
+	mu            sync.Mutex
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// newOIDCProvider configures the provider using its discovery document.
+func newOIDCProvider(ctx context.Context, cfg oidcConfig) (*oidcProvider, error) {
+	p := &oidcProvider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   map[string]crypto.PublicKey{},
+	}
+
+	if cfg.ClientSecretFile != "" {
+		secret, err := os.ReadFile(filepath.Clean(cfg.ClientSecretFile))
+		if err != nil {
+			return nil, fmt.Errorf("read client secret: %v", err)
+		}
+		p.clientSecret = string(bytes.TrimSpace(secret))
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discoveryURL, &discovery); err != nil {
+		return nil, fmt.Errorf("discover provider configuration: %v", err)
+	}
+
+	if discovery.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("discovered issuer %q doesn't match configured issuer %q", discovery.Issuer, cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+
+	p.issuer = discovery.Issuer
+	p.authorizationEndpoint = discovery.AuthorizationEndpoint
+	p.tokenEndpoint = discovery.TokenEndpoint
+	p.jwksURI = discovery.JWKSURI
+
+	return p, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", res.Status, url)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// publicKey returns the signing key with the id. The key set is fetched
+// again when the key is unknown, since the provider may have rotated its
+// keys, but not more often than once a minute.
+func (p *oidcProvider) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, exists := p.keys[kid]; exists {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetchedAt) < time.Minute {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %v", err)
+	}
+	p.keysFetchedAt = time.Now()
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Curve != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.KeyID] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			keys[k.KeyID] = ed25519.PublicKey(x)
+		}
+	}
+	p.keys = keys
+
+	key, exists := p.keys[kid]
+	if !exists {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signingInput, signature []byte) bool {
+	hash := sha256.Sum256(signingInput)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k, hash[:], r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(k, signingInput, signature)
+	}
+	return false
+}
+
+// verifyIDToken checks the signature of the ID token against the provider
+// keys, validates its claims and returns them.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, nonce string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("decode header: %v", err)
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("parse header: %v", err)
+	}
+
+	key, err := p.publicKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("decode payload: %v", err)
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("parse payload: %v", err)
+	}
+
+	var registered jwtClaims
+	if err := json.Unmarshal(payload, &registered); err != nil {
+		return nil, fmt.Errorf("parse payload: %v", err)
+	}
+
+	now := time.Now()
+	if registered.Issuer != p.issuer {
+		return nil, errors.New("unexpected issuer")
+	}
+	audienceMatch := false
+	for _, aud := range registered.Audience {
+		if aud == p.cfg.ClientID {
+			audienceMatch = true
+		}
+	}
+	if !audienceMatch {
+		return nil, errors.New("unexpected audience")
+	}
+	if registered.ExpiresAt == 0 || now.After(time.Unix(registered.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if now.Add(jwtLeeway).Before(time.Unix(registered.IssuedAt, 0)) {
+		return nil, errors.New("token is issued in the future")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+// oidcPrincipalPrefix starts the names of the principals of users logged in
+// with the identity provider, which can't collide with local users.
+const oidcPrincipalPrefix = "oidc:"
+
+// maxDisplayNameLength is the length of sessions.display_name, longer names
+// from the identity provider are truncated.
+const maxDisplayNameLength = 100
+
+// mapClaims returns the principal name, the display name and the role for
+// the ID token claims. The principal name is made of the issuer and the
+// subject, which users can't change at the provider, unlike the username
+// claim that is only displayed. The role is empty when none of the claim
+// values is mapped to a role.
+func (p *oidcProvider) mapClaims(claims map[string]any) (string, string, string, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return "", "", "", errors.New("ID token has no subject")
+	}
+	name := oidcPrincipalPrefix + p.issuer + "|" + subject
+	displayName, _ := claims[p.cfg.UsernameClaim].(string)
+	if displayName == "" {
+		displayName = subject
+	}
+	if runes := []rune(displayName); len(runes) > maxDisplayNameLength {
+		displayName = string(runes[:maxDisplayNameLength])
+	}
+
+	var values []string
+	switch v := claims[p.cfg.RolesClaim].(type) {
+	case string:
+		values = strings.Fields(v)
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	mapped := map[string]bool{}
+	for _, value := range values {
+		if role, exists := p.cfg.RoleMapping[value]; exists {
+			mapped[role] = true
+		}
+	}
+	for _, role := range oidcRolePriority {
+		if mapped[role] {
+			return name, displayName, role, nil
+		}
+	}
+
+	return name, displayName, "", nil
+}
+
+// oidcState is kept in a short-lived cookie between the redirect to the
+// provider and the callback, so that the callback can be handled by any
+// replica.
+type oidcState struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var st oidcState
+	var err error
+	for _, v := range []*string{&st.State, &st.Nonce, &st.CodeVerifier} {
+		if *v, err = randomString(32); err != nil {
+			requestLogger(r).Error("Failed to generate OIDC state", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		requestLogger(r).Error("Failed to encode OIDC state", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     "/login/oidc",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(st.CodeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {app.oidc.cfg.ClientID},
+		"redirect_uri":          {app.oidc.cfg.RedirectURL},
+		"scope":                 {strings.Join(app.oidc.cfg.Scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	http.Redirect(w, r, app.oidc.authorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		app.renderLoginPage(w, r, http.StatusBadRequest, "Login has expired, please try again")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Path: "/login/oidc", MaxAge: -1, Secure: true, HttpOnly: true})
+
+	var st oidcState
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || json.Unmarshal(data, &st) != nil || st.State == "" || r.FormValue("state") != st.State {
+		app.renderLoginPage(w, r, http.StatusBadRequest, "Login has expired, please try again")
+		return
+	}
+
+	if errorCode := r.FormValue("error"); errorCode != "" {
+		requestLogger(r).Warn("OIDC provider returned an error", "error", errorCode, "description", r.FormValue("error_description"))
+		app.renderLoginPage(w, r, http.StatusUnauthorized, "Login was not completed")
+		return
+	}
+
+	idToken, err := app.oidc.exchangeCode(r.Context(), r.FormValue("code"), st.CodeVerifier)
+	if err != nil {
+		requestLogger(r).Error("Failed to exchange OIDC authorization code", "error", err)
+		app.renderLoginPage(w, r, http.StatusBadGateway, "Login failed")
+		return
+	}
+
+	claims, err := app.oidc.verifyIDToken(r.Context(), idToken, st.Nonce)
+	if err != nil {
+		requestLogger(r).Error("Failed to verify ID token", "error", err)
+		app.renderLoginPage(w, r, http.StatusUnauthorized, "Login failed")
+		return
+	}
+
+	name, displayName, role, err := app.oidc.mapClaims(claims)
+	if err != nil {
+		requestLogger(r).Error("Failed to map ID token claims", "error", err)
+		app.renderLoginPage(w, r, http.StatusUnauthorized, "Login failed")
+		return
+	}
+	// Local users and their roles never apply to users of the provider
+	if role == "" {
+		role = app.roles.Default
+	}
+
+	if err := app.startSession(w, r, session{Username: name, DisplayName: displayName, Role: role}); err != nil {
+		requestLogger(r).Error("Failed to create session", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// exchangeCode redeems the authorization code at the token endpoint and
+// returns the ID token.
+func (p *oidcProvider) exchangeCode(ctx context.Context, code, codeVerifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.clientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode token response: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s: %s %s", res.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+
+	return body.IDToken, nil
+}
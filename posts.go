@@ -3,9 +3,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"slices"
 	"strconv"
@@ -16,9 +16,38 @@ import (
 )
 
 type post struct {
-	ID      int    `json:"id"`
-	Author  string `json:"author"`
-	Message string `json:"message"`
+	ID      int    `json:"id" xml:"id"`
+	Author  string `json:"author" xml:"author"`
+	Message string `json:"message" xml:"message"`
+	Owner   string `json:"owner,omitempty" xml:"owner,omitempty"`
+}
+
+var postCSVHeader = []string{"id", "author", "message", "owner"}
+
+func (p post) csvRecord() []string {
+	return []string{strconv.Itoa(p.ID), p.Author, p.Message, p.Owner}
+}
+
+func (p post) MarshalCSV() ([][]string, error) {
+	return [][]string{postCSVHeader, p.csvRecord()}, nil
+}
+
+// postCollection is a list of posts in the representations of getPosts.
+type postCollection []post
+
+func (c postCollection) MarshalCSV() ([][]string, error) {
+	records := [][]string{postCSVHeader}
+	for _, p := range c {
+		records = append(records, p.csvRecord())
+	}
+	return records, nil
+}
+
+func (c postCollection) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.Encode(struct {
+		XMLName xml.Name `xml:"posts"`
+		Posts   []post   `xml:"post"`
+	}{Posts: c})
 }
 
 var (
@@ -33,7 +62,32 @@ var (
 	mu     sync.Mutex
 )
 
-func (app *application) getPostsList() ([]post, error) {
+// validate trims the fields of the post and checks their lengths. Partial
+// posts, sent to update a post, may leave out either field.
+func (p *post) validate(partial bool) error {
+	p.Author = strings.TrimSpace(p.Author)
+	p.Message = strings.TrimSpace(p.Message)
+
+	if partial {
+		if p.Author == "" && p.Message == "" {
+			return &requestError{Status: http.StatusBadRequest, Message: "Bad request: no data provided"}
+		}
+	} else {
+		if p.Author == "" {
+			return fieldError("author", "Missing field: author")
+		}
+		if p.Message == "" {
+			return fieldError("message", "Missing field: message")
+		}
+	}
+
+	if err := checkLength("author", p.Author, maxAuthorLength); err != nil {
+		return err
+	}
+	return checkLength("message", p.Message, maxMessageLength)
+}
+
+func (app *application) getPostsList(ctx context.Context) ([]post, error) {
 	if !app.enabledModules["database"] {
 		mu.Lock()
 		defer mu.Unlock()
@@ -56,7 +110,7 @@ func (app *application) getPostsList() ([]post, error) {
 		return postList, nil
 	}
 
-	rows, err := app.db.Query(context.Background(), "SELECT * FROM posts ORDER BY id DESC")
+	rows, err := app.db.Query(ctx, "SELECT * FROM posts ORDER BY id DESC")
 	if err != nil {
 		return nil, fmt.Errorf("query database: %v", err)
 	}
@@ -80,39 +134,26 @@ func (app *application) getPosts(w http.ResponseWriter, r *http.Request) {
 			postList = append(postList, post)
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-
-		err := json.NewEncoder(w).Encode(postList)
-		if err != nil {
-			log.Printf("Failed to encode post to JSON: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+		writeNegotiated(w, r, postCollection(postList))
 		return
 	}
 
-	rows, err := app.db.Query(context.Background(), "SELECT * FROM posts")
+	rows, err := app.db.Query(r.Context(), "SELECT * FROM posts")
 	if err != nil {
-		log.Printf("Failed to query database: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to query database", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 	defer rows.Close()
 
 	postList, err := pgx.CollectRows(rows, pgx.RowToStructByPos[post])
 	if err != nil {
-		log.Printf("Failed to collect rows: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to collect rows", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(postList)
-	if err != nil {
-		log.Printf("Failed to encode posts: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
+	writeNegotiated(w, r, postCollection(postList))
 }
 
 func (app *application) getPost(w http.ResponseWriter, r *http.Request) {
@@ -124,59 +165,45 @@ func (app *application) getPost(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 		postID, err := strconv.Atoi(id)
 		if err != nil {
-			log.Printf("Failed to convert id from query to int: %v", err)
-			http.Error(w, "Invalid post id (id must be numeric)", http.StatusBadRequest)
+			requestLogger(r).Debug("Failed to convert id from query to int", "error", err)
+			writeProblem(w, r, http.StatusBadRequest, "Invalid post id (id must be numeric)")
 			return
 		}
 
 		post, exists := posts[postID]
 		if !exists {
-			http.Error(w, "Post not found", http.StatusNotFound)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-
-		err = json.NewEncoder(w).Encode(post)
-		if err != nil {
-			log.Printf("Failed to encode post to JSON: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
 			return
 		}
 
+		writeNegotiated(w, r, post)
 		return
 	}
 
 	id := r.PathValue("id")
 	postID, err := strconv.Atoi(id)
 	if err != nil {
-		log.Printf("Failed to convert id from query to int: %v", err)
-		http.Error(w, "Invalid post id (id must be numeric)", http.StatusBadRequest)
+		requestLogger(r).Debug("Failed to convert id from query to int", "error", err)
+		writeProblem(w, r, http.StatusBadRequest, "Invalid post id (id must be numeric)")
 		return
 	}
 
 	var post post
 
-	err = app.db.QueryRow(context.Background(), "SELECT id, author, message FROM posts WHERE id = $1", postID).Scan(
-		&post.ID, &post.Author, &post.Message,
+	err = app.db.QueryRow(r.Context(), "SELECT id, author, message, owner FROM posts WHERE id = $1", postID).Scan(
+		&post.ID, &post.Author, &post.Message, &post.Owner,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			http.Error(w, "Post not found", http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
 			return
 		}
-		log.Printf("Failed to query database: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to query database", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(post)
-	if err != nil {
-		log.Printf("Failed to encode post: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
+	writeNegotiated(w, r, post)
 }
 
 func (app *application) createPost(w http.ResponseWriter, r *http.Request) {
@@ -185,25 +212,18 @@ func (app *application) createPost(w http.ResponseWriter, r *http.Request) {
 		defer mu.Unlock()
 
 		var newPost post
-		if err := json.NewDecoder(r.Body).Decode(&newPost); err != nil {
-			log.Printf("Failed to parse payload: %v", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if err := decodeJSON(w, r, &newPost); err != nil {
+			writeRequestError(w, r, err)
 			return
 		}
 
-		newPost.Author = strings.TrimSpace(newPost.Author)
-		if newPost.Author == "" {
-			http.Error(w, "Missing field: author", http.StatusBadRequest)
-			return
-		}
-
-		newPost.Message = strings.TrimSpace(newPost.Message)
-		if newPost.Message == "" {
-			http.Error(w, "Missing field: message", http.StatusBadRequest)
+		if err := newPost.validate(false); err != nil {
+			writeRequestError(w, r, err)
 			return
 		}
 
 		newPost.ID = nextID
+		newPost.Owner = postOwner(r)
 		nextID++
 
 		posts[newPost.ID] = newPost
@@ -212,46 +232,38 @@ func (app *application) createPost(w http.ResponseWriter, r *http.Request) {
 
 		err := json.NewEncoder(w).Encode(newPost)
 		if err != nil {
-			log.Printf("Failed to encode post to JSON: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			requestLogger(r).Error("Failed to encode post to JSON", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "")
 			return
 		}
 		return
 	}
 
 	var newPost post
-	if err := json.NewDecoder(r.Body).Decode(&newPost); err != nil {
-		log.Printf("Failed to parse payload: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := decodeJSON(w, r, &newPost); err != nil {
+		writeRequestError(w, r, err)
 		return
 	}
 
-	newPost.Author = strings.TrimSpace(newPost.Author)
-	if newPost.Author == "" {
-		http.Error(w, "Missing field: author", http.StatusBadRequest)
+	if err := newPost.validate(false); err != nil {
+		writeRequestError(w, r, err)
 		return
 	}
 
-	newPost.Message = strings.TrimSpace(newPost.Message)
-	if newPost.Message == "" {
-		http.Error(w, "Missing field: message", http.StatusBadRequest)
-		return
-	}
-
-	err := app.db.QueryRow(context.Background(), "INSERT INTO posts(author, message) VALUES ($1, $2) RETURNING id, author, message", newPost.Author, newPost.Message).Scan(
-		&newPost.ID, &newPost.Author, &newPost.Message,
+	err := app.db.QueryRow(r.Context(), "INSERT INTO posts(author, message, owner) VALUES ($1, $2, $3) RETURNING id, author, message, owner", newPost.Author, newPost.Message, postOwner(r)).Scan(
+		&newPost.ID, &newPost.Author, &newPost.Message, &newPost.Owner,
 	)
 	if err != nil {
-		log.Printf("Failed to query database: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to query database", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(w).Encode(newPost)
 	if err != nil {
-		log.Printf("Failed to encode post: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to encode post", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 }
@@ -264,33 +276,35 @@ func (app *application) updatePost(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 		postID, err := strconv.Atoi(id)
 		if err != nil {
-			log.Printf("Failed to convert id from query to int: %v", err)
-			http.Error(w, "Invalid post id (id must be numeric)", http.StatusBadRequest)
+			requestLogger(r).Debug("Failed to convert id from query to int", "error", err)
+			writeProblem(w, r, http.StatusBadRequest, "Invalid post id (id must be numeric)")
 			return
 		}
 
 		originalPost, exists := posts[postID]
 		if !exists {
-			http.Error(w, "Post not found", http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
 			return
 		}
 
-		var updatedPost post
-		if err := json.NewDecoder(r.Body).Decode(&updatedPost); err != nil {
-			log.Printf("Failed to parse payload: %v", err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if !canModifyPost(r, originalPost.Owner) {
+			writeProblem(w, r, http.StatusForbidden, "Authors can only update their own posts")
 			return
 		}
 
-		updatedPost.Author = strings.TrimSpace(updatedPost.Author)
-		updatedPost.Message = strings.TrimSpace(updatedPost.Message)
+		var updatedPost post
+		if err := decodeJSON(w, r, &updatedPost); err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
 
-		if updatedPost.Author == "" && updatedPost.Message == "" {
-			http.Error(w, "Bad request: no data provided", http.StatusBadRequest)
+		if err := updatedPost.validate(true); err != nil {
+			writeRequestError(w, r, err)
 			return
 		}
 
 		updatedPost.ID = postID
+		updatedPost.Owner = originalPost.Owner
 
 		if updatedPost.Author == "" {
 			updatedPost.Author = originalPost.Author
@@ -305,8 +319,8 @@ func (app *application) updatePost(w http.ResponseWriter, r *http.Request) {
 
 		err = json.NewEncoder(w).Encode(updatedPost)
 		if err != nil {
-			log.Printf("Failed to encode post to JSON: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			requestLogger(r).Error("Failed to encode post to JSON", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "")
 			return
 		}
 
@@ -316,38 +330,39 @@ func (app *application) updatePost(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	postID, err := strconv.Atoi(id)
 	if err != nil {
-		log.Printf("Failed to convert id from query to int: %v", err)
-		http.Error(w, "Invalid post id (id must be numeric)", http.StatusBadRequest)
+		requestLogger(r).Debug("Failed to convert id from query to int", "error", err)
+		writeProblem(w, r, http.StatusBadRequest, "Invalid post id (id must be numeric)")
 		return
 	}
 
 	var originalPost post
 
-	err = app.db.QueryRow(context.Background(), "SELECT id, author, message FROM posts WHERE id = $1", postID).Scan(
-		&originalPost.ID, &originalPost.Author, &originalPost.Message,
+	err = app.db.QueryRow(r.Context(), "SELECT id, author, message, owner FROM posts WHERE id = $1", postID).Scan(
+		&originalPost.ID, &originalPost.Author, &originalPost.Message, &originalPost.Owner,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			http.Error(w, "Post not found", http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
 			return
 		}
-		log.Printf("Failed to query database: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to query database", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
-	var updatedPost post
-	if err := json.NewDecoder(r.Body).Decode(&updatedPost); err != nil {
-		log.Printf("Failed to parse payload: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !canModifyPost(r, originalPost.Owner) {
+		writeProblem(w, r, http.StatusForbidden, "Authors can only update their own posts")
 		return
 	}
 
-	updatedPost.Author = strings.TrimSpace(updatedPost.Author)
-	updatedPost.Message = strings.TrimSpace(updatedPost.Message)
+	var updatedPost post
+	if err := decodeJSON(w, r, &updatedPost); err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
 
-	if updatedPost.Author == "" && updatedPost.Message == "" {
-		http.Error(w, "Bad request: no data provided", http.StatusBadRequest)
+	if err := updatedPost.validate(true); err != nil {
+		writeRequestError(w, r, err)
 		return
 	}
 
@@ -360,24 +375,24 @@ func (app *application) updatePost(w http.ResponseWriter, r *http.Request) {
 		updatedPost.Message = originalPost.Message
 	}
 
-	err = app.db.QueryRow(context.Background(), "UPDATE posts SET author = $1, message = $2 WHERE id = $3 RETURNING id, author, message", updatedPost.Author, updatedPost.Message, updatedPost.ID).Scan(
-		&updatedPost.ID, &updatedPost.Author, &updatedPost.Message,
+	err = app.db.QueryRow(r.Context(), "UPDATE posts SET author = $1, message = $2 WHERE id = $3 RETURNING id, author, message, owner", updatedPost.Author, updatedPost.Message, updatedPost.ID).Scan(
+		&updatedPost.ID, &updatedPost.Author, &updatedPost.Message, &updatedPost.Owner,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			http.Error(w, "Post not found", http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
 			return
 		}
-		log.Printf("Failed to query database: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to query database", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(updatedPost)
 	if err != nil {
-		log.Printf("Failed to encode post: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to encode post", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 }
@@ -390,13 +405,19 @@ func (app *application) deletePost(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 		postID, err := strconv.Atoi(id)
 		if err != nil {
-			log.Printf("Failed to convert id from query to int: %v", err)
-			http.Error(w, "Invalid post id (id must be numeric)", http.StatusBadRequest)
+			requestLogger(r).Debug("Failed to convert id from query to int", "error", err)
+			writeProblem(w, r, http.StatusBadRequest, "Invalid post id (id must be numeric)")
 			return
 		}
 
-		if _, exists := posts[postID]; !exists {
-			http.Error(w, "Post not found", http.StatusNotFound)
+		post, exists := posts[postID]
+		if !exists {
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
+			return
+		}
+
+		if !canModifyPost(r, post.Owner) {
+			writeProblem(w, r, http.StatusForbidden, "Authors can only delete their own posts")
 			return
 		}
 
@@ -408,20 +429,37 @@ func (app *application) deletePost(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	postID, err := strconv.Atoi(id)
 	if err != nil {
-		log.Printf("Failed to convert id from query to int: %v", err)
-		http.Error(w, "Invalid post id (id must be numeric)", http.StatusBadRequest)
+		requestLogger(r).Debug("Failed to convert id from query to int", "error", err)
+		writeProblem(w, r, http.StatusBadRequest, "Invalid post id (id must be numeric)")
+		return
+	}
+
+	var owner string
+	err = app.db.QueryRow(r.Context(), "SELECT owner FROM posts WHERE id = $1", postID).Scan(&owner)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
+			return
+		}
+		requestLogger(r).Error("Failed to query database", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	if !canModifyPost(r, owner) {
+		writeProblem(w, r, http.StatusForbidden, "Authors can only delete their own posts")
 		return
 	}
 
 	var post post
-	err = app.db.QueryRow(context.Background(), "DELETE FROM posts WHERE id = $1 RETURNING id, author, message", postID).Scan(&post.ID, &post.Author, &post.Message)
+	err = app.db.QueryRow(r.Context(), "DELETE FROM posts WHERE id = $1 RETURNING id, author, message, owner", postID).Scan(&post.ID, &post.Author, &post.Message, &post.Owner)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			http.Error(w, "Post not found", http.StatusNotFound)
+			writeProblem(w, r, http.StatusNotFound, "Post not found")
 			return
 		}
-		log.Printf("Failed to query database: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		requestLogger(r).Error("Failed to query database", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
 		return
 	}
 
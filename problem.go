@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// problem is an RFC 9457 problem details object.
+type problem struct {
+	Type      string         `json:"type"`
+	Title     string         `json:"title"`
+	Status    int            `json:"status"`
+	Detail    string         `json:"detail,omitempty"`
+	Instance  string         `json:"instance,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Errors    []fieldProblem `json:"errors,omitempty"`
+}
+
+// fieldProblem is an invalid field of the request body. Pointer is a JSON
+// pointer to the field, e.g. "#/author".
+type fieldProblem struct {
+	Detail  string `json:"detail"`
+	Pointer string `json:"pointer"`
+}
+
+// writeProblem responds with a problem details object. The detail may be
+// empty when the status says it all.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblemDetails(w, r, problem{Status: status, Detail: detail})
+}
+
+func writeProblemDetails(w http.ResponseWriter, r *http.Request, p problem) {
+	// Browsers navigating the web UI get the error as text
+	if acceptsHTML(r) {
+		text := p.Detail
+		if text == "" {
+			text = http.StatusText(p.Status)
+		}
+		http.Error(w, text, p.Status)
+		return
+	}
+
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = r.URL.Path
+	p.RequestID = requestID(r)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+
+	err := json.NewEncoder(w).Encode(p)
+	if err != nil {
+		requestLogger(r).Error("Failed to encode problem", "error", err)
+		return
+	}
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// notFoundHandler answers the requests that match no route of the mux. When
+// the path exists with other methods, it responds with 405 and the Allow
+// header like the mux does.
+func notFoundHandler(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if _, pattern := mux.Handler(probe); pattern != "" && pattern != "/" {
+				allowed = append(allowed, method)
+			}
+		}
+
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeProblem(w, r, http.StatusMethodNotAllowed, "")
+			return
+		}
+		writeProblem(w, r, http.StatusNotFound, "")
+	}
+}
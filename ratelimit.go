@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// rateLimiter implements token buckets. Each bucket holds up to limit.Burst
+// tokens and is refilled with limit.Requests tokens per limit.Period. A
+// request takes one token.
+type rateLimiter interface {
+	// take takes a token from the bucket with the key, if there is one, and
+	// returns the tokens left.
+	take(ctx context.Context, key string, limit rateLimit) (allowed bool, remaining float64, err error)
+}
+
+func (l rateLimit) ratePerSecond() float64 {
+	return float64(l.Requests) / time.Duration(l.Period).Seconds()
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is refilled if no more tokens are taken.
+	full time.Time
+}
+
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]bucket
+	calls   int
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: map[string]bucket{}}
+}
+
+func (l *memoryRateLimiter) take(ctx context.Context, key string, limit rateLimit) (bool, float64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, exists := l.buckets[key]
+	if !exists {
+		b = bucket{tokens: float64(limit.Burst), updated: now}
+	}
+
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.ratePerSecond())
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.ratePerSecond() * float64(time.Second)))
+	l.buckets[key] = b
+
+	// Every now and then forget the buckets that have been refilled, they
+	// are the same as new ones
+	l.calls++
+	if l.calls%1000 == 0 {
+		for k, b := range l.buckets {
+			if now.After(b.full) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	return allowed, b.tokens, nil
+}
+
+// postgresRateLimiter keeps the buckets in the database, so that the limits
+// hold across replicas.
+type postgresRateLimiter struct {
+	db *pgxpool.Pool
+	// longestRefill returns how long the slowest bucket takes to refill
+	// from empty, as currently configured.
+	longestRefill func() time.Duration
+	calls         atomic.Int64
+}
+
+func (l *postgresRateLimiter) take(ctx context.Context, key string, limit rateLimit) (bool, float64, error) {
+	// Every now and then forget the buckets that have been refilled, they
+	// are the same as new ones
+	if l.calls.Add(1)%1000 == 0 {
+		_, err := l.db.Exec(ctx, "DELETE FROM rate_limits WHERE updated_at < now() - make_interval(secs => $1)", l.longestRefill().Seconds())
+		if err != nil {
+			slog.Error("Failed to delete refilled rate limit buckets", "error", err)
+		}
+	}
+
+	var allowed bool
+	var tokens float64
+	err := l.db.QueryRow(ctx, `INSERT INTO rate_limits(key, tokens, allowed, updated_at) VALUES ($1, $2 - 1, true, now())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = CASE
+				WHEN LEAST($2, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at) * $3) >= 1
+				THEN LEAST($2, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at) * $3) - 1
+				ELSE LEAST($2, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at) * $3)
+			END,
+			allowed = LEAST($2, rate_limits.tokens + EXTRACT(EPOCH FROM now() - rate_limits.updated_at) * $3) >= 1,
+			updated_at = now()
+		RETURNING allowed, tokens`, key, float64(limit.Burst), limit.ratePerSecond()).Scan(&allowed, &tokens)
+	return allowed, tokens, err
+}
+
+// longestRefill returns how long the slowest of the limits takes to refill a
+// bucket from empty.
+func (cfg rateLimitConfig) longestRefill() time.Duration {
+	var longest time.Duration
+	for _, limit := range append(slices.Collect(maps.Values(cfg.Routes)), cfg.Default, cfg.PreAuth) {
+		if limit.Requests > 0 {
+			longest = max(longest, time.Duration(float64(limit.Burst)/limit.ratePerSecond()*float64(time.Second)))
+		}
+	}
+	return longest
+}
+
+// rateLimitIdentity returns who the limit of the request is counted for:
+// the client address, or the authenticated user or API key when the limit
+// is by identity.
+func rateLimitIdentity(r *http.Request, limit rateLimit) string {
+	if limit.By == "identity" {
+		if p, ok := principalFromContext(r.Context()); ok {
+			return p.name
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// routeLimit returns the limit of the route registered with the pattern, as
+// currently configured.
+func (app *application) routeLimit(pattern string) rateLimit {
+	limits := app.rateLimits.Load()
+	limit, exists := limits.Routes[pattern]
+	if !exists {
+		limit = limits.Default
+	}
+	return limit
+}
+
+// clientRateLimitMiddleware limits the requests to the route registered with
+// the pattern by client address. It runs before authentication, so that
+// requests with missing or wrong credentials are limited too: routes limited
+// by identity are limited by the pre-authentication limit here.
+func (app *application) clientRateLimitMiddleware(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := app.routeLimit(pattern)
+		key := pattern + "|ip:" + clientIP(r)
+		if limit.By == "identity" {
+			limit = app.rateLimits.Load().PreAuth
+			key = pattern + "|pre_auth|ip:" + clientIP(r)
+		}
+
+		if takeRateLimit(app.rateLimiter, w, r, key, limit) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// rateLimitMiddleware limits the requests to the route registered with the
+// pattern by identity, when the route is limited by identity. It runs after
+// authentication.
+func (app *application) rateLimitMiddleware(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := app.routeLimit(pattern)
+		if limit.By != "identity" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if takeRateLimit(app.rateLimiter, w, r, pattern+"|"+rateLimitIdentity(r, limit), limit) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// takeRateLimit takes a token for the request from the bucket of the limiter
+// with the key and sets the rate limit headers. It writes a 429 response and
+// returns false when the limit is exceeded.
+func takeRateLimit(limiter rateLimiter, w http.ResponseWriter, r *http.Request, key string, limit rateLimit) bool {
+	// Routes with no requests configured aren't limited
+	if limit.Requests == 0 {
+		return true
+	}
+
+	allowed, remaining, err := limiter.take(r.Context(), key, limit)
+	if err != nil {
+		// Fail open, an unavailable limiter shouldn't take the API down
+		requestLogger(r).Error("Failed to check rate limit", "error", err)
+		return true
+	}
+
+	rate := limit.ratePerSecond()
+	reset := (float64(limit.Burst) - remaining) / rate
+
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(time.Duration(limit.Period).Seconds())))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(math.Floor(remaining))))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset))))
+
+	if !allowed {
+		setRetryAfter(w, time.Duration((1-remaining)/rate*float64(time.Second)))
+		writeProblem(w, r, http.StatusTooManyRequests, "")
+		return false
+	}
+	return true
+}
+
+// normalize fills in the burst (the number of requests) and the identity (the
+// client address) where they are left out, and validates the limits.
+func (cfg rateLimitConfig) normalize() (rateLimitConfig, error) {
+	normalizeLimit := func(name string, limit rateLimit) (rateLimit, error) {
+		if limit.Requests == 0 {
+			return limit, nil
+		}
+		if limit.Burst == 0 {
+			limit.Burst = limit.Requests
+		}
+		if limit.By == "" {
+			limit.By = "ip"
+		}
+
+		if limit.Requests < 0 || limit.Period <= 0 || limit.Burst < 1 {
+			return limit, fmt.Errorf("%s: requests, period and burst must be positive", name)
+		}
+		if limit.By != "ip" && limit.By != "identity" {
+			return limit, fmt.Errorf("%s: by must be ip or identity", name)
+		}
+		return limit, nil
+	}
+
+	var err error
+	normalized := rateLimitConfig{Routes: map[string]rateLimit{}}
+
+	normalized.Default, err = normalizeLimit("default", cfg.Default)
+	if err != nil {
+		return rateLimitConfig{}, err
+	}
+	normalized.PreAuth, err = normalizeLimit("pre_auth", cfg.PreAuth)
+	if err != nil {
+		return rateLimitConfig{}, err
+	}
+	if normalized.PreAuth.By != "ip" && normalized.PreAuth.Requests != 0 {
+		return rateLimitConfig{}, errors.New("pre_auth: by must be ip")
+	}
+	for pattern, limit := range cfg.Routes {
+		normalized.Routes[pattern], err = normalizeLimit(pattern, limit)
+		if err != nil {
+			return rateLimitConfig{}, err
+		}
+	}
+
+	return normalized, nil
+}
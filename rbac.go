@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// permLockoutsManage allows clearing failed login attempts.
+const permLockoutsManage = "lockouts:manage"
+
+const (
+	roleAdmin  = "admin"
+	roleEditor = "editor"
+	roleAuthor = "author"
+	roleViewer = "viewer"
+)
+
+type role struct {
+	permissions []string
+	// ownPostsOnly restricts updating and deleting to the posts created by
+	// the user.
+	ownPostsOnly bool
+}
+
+var roles = map[string]role{
+	roleAdmin:  {permissions: []string{scopePostsRead, scopePostsWrite, scopePostsDelete, scopeKeysManage, permLockoutsManage, permDebug, scopeMetricsRead}},
+	roleEditor: {permissions: []string{scopePostsRead, scopePostsWrite, scopePostsDelete}},
+	roleAuthor: {permissions: []string{scopePostsRead, scopePostsWrite, scopePostsDelete}, ownPostsOnly: true},
+	roleViewer: {permissions: []string{scopePostsRead}},
+}
+
+type routePolicy struct {
+	permission string
+	// allowAnonymous lets through requests without credentials, but
+	// requests presenting credentials must still hold the permission.
+	allowAnonymous bool
+}
+
+// routePolicies maps the route patterns registered with app.handle to the
+// permission required to use them.
+var routePolicies = map[string]routePolicy{
+	"GET /api/v1/posts":         {permission: scopePostsRead, allowAnonymous: true},
+	"GET /api/v1/posts/{id}":    {permission: scopePostsRead, allowAnonymous: true},
+	"POST /api/v1/posts":        {permission: scopePostsWrite},
+	"PUT /api/v1/posts/{id}":    {permission: scopePostsWrite},
+	"DELETE /api/v1/posts/{id}": {permission: scopePostsDelete},
+	"POST /api/v1/keys":         {permission: scopeKeysManage},
+	"GET /api/v1/keys":          {permission: scopeKeysManage},
+	"DELETE /api/v1/keys/{id}":  {permission: scopeKeysManage},
+
+	"POST /api/v1/lockouts/unlock": {permission: permLockoutsManage},
+	"/debug/":                      {permission: permDebug},
+	"GET /metrics":                 {permission: scopeMetricsRead},
+}
+
+func (rc rolesConfig) validate() error {
+	if _, exists := roles[rc.Default]; !exists {
+		return fmt.Errorf("unknown default role %q", rc.Default)
+	}
+	for username, name := range rc.Users {
+		if _, exists := roles[name]; !exists {
+			return fmt.Errorf("unknown role %q for user %q", name, username)
+		}
+	}
+	return nil
+}
+
+type principalContextKey struct{}
+
+// principal is an authenticated caller. Users get the permissions of their
+// role, API keys get the permissions of their scopes.
+type principal struct {
+	name         string
+	role         string
+	permissions  []string
+	ownPostsOnly bool
+}
+
+func (p principal) can(permission string) bool {
+	return slices.Contains(p.permissions, permission)
+}
+
+// userPrincipal returns the principal for an authenticated user. The user
+// configured with AUTH_USERNAME is an admin unless the roles configuration
+// says otherwise, users of the htpasswd file get the default role unless
+// they're listed.
+func (app *application) userPrincipal(username string) principal {
+	name, exists := app.roles.Users[username]
+	if !exists {
+		name = app.roles.Default
+		if app.auth.username != "" && username == app.auth.username {
+			name = roleAdmin
+		}
+	}
+
+	return rolePrincipal(username, name)
+}
+
+func rolePrincipal(username, name string) principal {
+	r := roles[name]
+	return principal{name: username, role: name, permissions: r.permissions, ownPostsOnly: r.ownPostsOnly}
+}
+
+// principalFromContext returns the principal stored by authorize, if the
+// request was authenticated.
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalContextKey{}).(principal)
+	return p, ok
+}
+
+// handle registers the handler for the pattern, protected by the policy for
+// the pattern in routePolicies. Patterns without a policy are public.
+// Requests are rate limited by client address before authentication, and
+// again after authorization for limits by identity, which need to know the
+// caller. The timeouts of server.routes apply to the pattern, which
+// must be listed in knownRoutes.
+func (app *application) handle(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	handler = app.liveRouteTimeoutMiddleware(pattern, handler)
+	if app.enabledModules["ratelimit"] {
+		handler = app.rateLimitMiddleware(pattern, handler)
+	}
+	if policy, exists := routePolicies[pattern]; exists {
+		handler = app.authorize(policy, handler)
+	}
+	// Limit by client address before authentication, so that failed
+	// authentication isn't free
+	if app.enabledModules["ratelimit"] {
+		handler = app.clientRateLimitMiddleware(pattern, handler)
+	}
+	mux.Handle(pattern, handler)
+}
+
+func (app *application) authorize(policy routePolicy, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Return early if auth is disabled
+		if !app.enabledModules["auth"] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := app.authenticate(r)
+		if err != nil {
+			if errors.Is(err, errNoCredentials) && policy.allowAnonymous {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if retryAfter, ok := retryAfterFromError(err); ok {
+				setRetryAfter(w, retryAfter)
+				writeProblem(w, r, http.StatusTooManyRequests, "Too many failed attempts")
+				return
+			}
+
+			switch {
+			case errors.Is(err, errInvalidToken):
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			case errors.Is(err, errNoCredentials), errors.Is(err, errInvalidCredentials):
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			default:
+				requestLogger(r).Error("Failed to authenticate", "error", err)
+				writeProblem(w, r, http.StatusInternalServerError, "")
+				return
+			}
+			writeProblem(w, r, http.StatusUnauthorized, "")
+			return
+		}
+
+		if info := logInfoFromContext(r.Context()); info != nil {
+			info.user = p.name
+		}
+
+		if !p.can(policy.permission) {
+			writeProblem(w, r, http.StatusForbidden, fmt.Sprintf("Missing permission %s", policy.permission))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey{}, p)
+		ctx = context.WithValue(ctx, loggerContextKey{}, requestLogger(r).With("user", p.name))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// canModifyPost reports whether the caller of the request may update or
+// delete a post owned by owner.
+func canModifyPost(r *http.Request, owner string) bool {
+	p, ok := principalFromContext(r.Context())
+	if !ok || !p.ownPostsOnly {
+		return true
+	}
+	return owner != "" && owner == p.name
+}
+
+// postOwner returns the name to record as the owner of a new post.
+func postOwner(r *http.Request) string {
+	p, ok := principalFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return p.name
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// liveModules can be enabled and disabled by reloading the configuration.
+// They keep no state, so they're wired in even when disabled.
+var liveModules = []string{"compression", "cors"}
+
+// liveSections are the sections of the configuration applied by a reload.
+// Changes to the other sections only take effect after a restart.
+var liveSections = []string{"rate_limit", "cors", "reload_interval"}
+
+// liveServerFields are the fields of the server section applied by a reload.
+// The read and write timeouts are set on every request, the other fields are
+// those of the http.Server, which can't be changed while it serves.
+var liveServerFields = []string{"read_timeout", "write_timeout", "routes"}
+
+// currentConfig returns the configuration, as last reloaded.
+func (app *application) currentConfig() *config {
+	return app.config.Load()
+}
+
+// liveModuleEnabled reports whether a module of liveModules is currently
+// enabled.
+func (app *application) liveModuleEnabled(module string) bool {
+	return slices.Contains(app.currentConfig().Modules, module)
+}
+
+// whenModuleEnabled serves requests with the middleware while the live module
+// is enabled, and with next otherwise.
+func (app *application) whenModuleEnabled(module string, middleware, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.liveModuleEnabled(module) {
+			middleware.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reloadConfig loads the configuration again with the arguments of the
+// process, applies what can be applied while the server runs, and reports
+// what requires a restart. The current configuration is kept when the new
+// one is invalid.
+func (app *application) reloadConfig() {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	next, err := loadConfig(app.configArgs, os.LookupEnv)
+	if err != nil {
+		for _, err := range configErrors(err) {
+			slog.Error("Invalid configuration, keeping the current one", "error", err)
+		}
+		return
+	}
+
+	current := app.currentConfig()
+	applied, restart := applyConfig(current, &next)
+
+	// Rate limits are normalized when loaded, validation passed already
+	if app.enabledModules["ratelimit"] && slices.Contains(applied, "rate_limit") {
+		rateLimits, _ := next.RateLimit.normalize()
+		app.rateLimits.Store(&rateLimits)
+	}
+	if slices.Contains(applied, "log.level") {
+		level, _ := next.Log.level()
+		logLevel.Set(level)
+	}
+	app.config.Store(&next)
+
+	if len(applied) == 0 && len(restart) == 0 {
+		slog.Info("Reloaded configuration, nothing changed")
+		return
+	}
+	if len(applied) > 0 {
+		slog.Info("Reloaded configuration", "applied", strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		slog.Warn("Configuration changes require a restart", "fields", strings.Join(restart, ", "))
+	}
+}
+
+// applyConfig compares the next configuration with the current one, and
+// reverts in next the changes that can't be applied live. It returns the
+// names of the fields applied and of those requiring a restart. Reverted
+// changes keep being reported by further reloads until the restart.
+func applyConfig(current, next *config) (applied, restart []string) {
+	if next.Log.Level != current.Log.Level {
+		applied = append(applied, "log.level")
+	}
+	if next.Log.Format != current.Log.Format {
+		restart = append(restart, "log.format")
+		next.Log.Format = current.Log.Format
+	}
+
+	// Only the live modules are toggled, the others keep their state
+	var modules []string
+	for _, module := range current.Modules {
+		if !slices.Contains(liveModules, module) {
+			modules = append(modules, module)
+		}
+	}
+	for _, module := range next.Modules {
+		if slices.Contains(liveModules, module) {
+			modules = append(modules, module)
+		}
+	}
+	for _, module := range next.Modules {
+		if !slices.Contains(current.Modules, module) {
+			if slices.Contains(liveModules, module) {
+				applied = append(applied, "modules: enabled "+module)
+			} else {
+				restart = append(restart, "modules: enabled "+module)
+			}
+		}
+	}
+	for _, module := range current.Modules {
+		if !slices.Contains(next.Modules, module) {
+			if slices.Contains(liveModules, module) {
+				applied = append(applied, "modules: disabled "+module)
+			} else {
+				restart = append(restart, "modules: disabled "+module)
+			}
+		}
+	}
+	next.Modules = modules
+
+	currentServer := reflect.ValueOf(&current.Server).Elem()
+	nextServer := reflect.ValueOf(&next.Server).Elem()
+	for i := range nextServer.NumField() {
+		name, _, _ := strings.Cut(nextServer.Type().Field(i).Tag.Get("json"), ",")
+		if reflect.DeepEqual(currentServer.Field(i).Interface(), nextServer.Field(i).Interface()) {
+			continue
+		}
+
+		if slices.Contains(liveServerFields, name) {
+			applied = append(applied, "server."+name)
+			continue
+		}
+		restart = append(restart, "server."+name)
+		nextServer.Field(i).Set(currentServer.Field(i))
+	}
+
+	currentValue := reflect.ValueOf(current).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	for i := range nextValue.NumField() {
+		name, _, _ := strings.Cut(nextValue.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "log" || name == "modules" || name == "server" {
+			continue
+		}
+		if reflect.DeepEqual(currentValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			continue
+		}
+
+		// The rate limiter only exists when the module was enabled at startup
+		live := slices.Contains(liveSections, name)
+		if name == "rate_limit" && !slices.Contains(current.Modules, "ratelimit") {
+			live = false
+		}
+		if live {
+			applied = append(applied, name)
+			continue
+		}
+		restart = append(restart, name)
+		nextValue.Field(i).Set(currentValue.Field(i))
+	}
+
+	return applied, restart
+}
+
+// watchConfigDisabledInterval is how often watchConfig checks whether the
+// checks were enabled again by a reload on SIGHUP, while they're disabled.
+const watchConfigDisabledInterval = time.Second
+
+// watchConfig reloads the configuration whenever the modification time or
+// the size of its file changes, checking every interval as currently
+// configured. The checks are skipped while the interval is zero.
+func (app *application) watchConfig() {
+	info, err := os.Stat(app.currentConfig().file)
+	if err != nil {
+		slog.Error("Failed to check configuration file", "error", err)
+	}
+
+	for {
+		cfg := app.currentConfig()
+		if cfg.ReloadInterval <= 0 {
+			time.Sleep(watchConfigDisabledInterval)
+			continue
+		}
+		time.Sleep(time.Duration(cfg.ReloadInterval))
+
+		latest, err := os.Stat(cfg.file)
+		if err != nil {
+			slog.Error("Failed to check configuration file", "error", err)
+			continue
+		}
+		if info != nil && latest.ModTime().Equal(info.ModTime()) && latest.Size() == info.Size() {
+			continue
+		}
+		info = latest
+
+		slog.Info("Configuration file changed", "path", cfg.file)
+		app.reloadConfig()
+	}
+}
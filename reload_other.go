@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// reloadOnSignal does nothing on systems without SIGHUP.
+func (app *application) reloadOnSignal() {}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnSignal reloads the configuration on SIGHUP.
+func (app *application) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for range c {
+			app.reloadConfig()
+		}
+	}()
+}
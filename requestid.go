@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+type requestIDContextKey struct{}
+
+// requestID returns the ID of the request, set by requestIDMiddleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether an ID sent by the client or nginx can be
+// reused: up to 128 letters, digits, dashes, underscores and dots.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware identifies every request by the X-Request-ID header,
+// generating an ID when the request has none, and echoes it in the response.
+// The logger of the request adds the ID to its records.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			_, _ = rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		ctx = context.WithValue(ctx, loggerContextKey{}, slog.Default().With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
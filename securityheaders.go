@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type cspNonceContextKey struct{}
+
+// cspNonce returns the nonce of the Content-Security-Policy of the request.
+// Templates put it on their script elements.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceContextKey{}).(string)
+	return nonce
+}
+
+// contentSecurityPolicy returns the policy with the nonce placeholder
+// replaced, and the frame-ancestors and report-uri directives added.
+func (cfg securityHeadersConfig) contentSecurityPolicy(nonce string) string {
+	directives := []string{strings.ReplaceAll(cfg.ContentSecurityPolicy, "{nonce}", nonce)}
+	if cfg.FrameAncestors != "" {
+		directives = append(directives, "frame-ancestors "+cfg.FrameAncestors)
+	}
+	if cfg.ReportURI != "" {
+		directives = append(directives, "report-uri "+cfg.ReportURI)
+	}
+	return strings.Join(directives, "; ")
+}
+
+func (cfg securityHeadersConfig) strictTransportSecurity() string {
+	value := fmt.Sprintf("max-age=%d", int(time.Duration(cfg.HSTSMaxAge).Seconds()))
+	if cfg.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if cfg.HSTSPreload {
+		value += "; preload"
+	}
+	return value
+}
+
+// securityHeadersMiddleware sets the security headers of every response.
+// Headers configured as empty aren't sent. Each request gets a fresh nonce
+// for the Content-Security-Policy, available through cspNonce.
+func securityHeadersMiddleware(cfg securityHeadersConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if cfg.HSTSMaxAge > 0 {
+			h.Set("Strict-Transport-Security", cfg.strictTransportSecurity())
+		}
+		if cfg.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", cfg.ReferrerPolicy)
+		}
+		if cfg.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", cfg.PermissionsPolicy)
+		}
+
+		if cfg.ContentSecurityPolicy != "" {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				requestLogger(r).Error("Failed to generate CSP nonce", "error", err)
+				writeProblem(w, r, http.StatusInternalServerError, "")
+				return
+			}
+			nonce := base64.StdEncoding.EncodeToString(b)
+
+			header := "Content-Security-Policy"
+			if cfg.CSPReportOnly {
+				header = "Content-Security-Policy-Report-Only"
+			}
+			h.Set(header, cfg.contentSecurityPolicy(nonce))
+
+			r = r.WithContext(context.WithValue(r.Context(), cspNonceContextKey{}, nonce))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cspReportPath is where cspReportHandler is registered.
+const cspReportPath = "/csp-report"
+
+// maxLoggedCSPReport is how much of a report is logged, reports are usually
+// well below.
+const maxLoggedCSPReport = 4 << 10
+
+// cspReportLimit bounds the reports logged per client address when the
+// ratelimit module is disabled, since anyone can send them.
+var cspReportLimit = rateLimit{Requests: 10, Period: duration(time.Minute), Burst: 10, By: "ip"}
+
+// cspReportHandler logs the Content-Security-Policy violations reported by
+// browsers, in either the report-uri or the Reporting API format.
+func cspReportHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "")
+		return
+	}
+
+	report := strings.TrimSpace(string(body))
+	truncated := len(report) > maxLoggedCSPReport
+	if truncated {
+		report = strings.ToValidUTF8(report[:maxLoggedCSPReport], "")
+	}
+	requestLogger(r).Warn("CSP violation reported", "client_ip", clientIP(r), "report", report, "truncated", truncated)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cspReportLimitMiddleware limits the reports by client address with
+// cspReportLimit.
+func cspReportLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	limiter := newMemoryRateLimiter()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if takeRateLimit(limiter, w, r, "ip:"+clientIP(r), cspReportLimit) {
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// newHTTPServer creates the server of the API and the web UI with the
+// timeouts and limits of the configuration.
+func newHTTPServer(cfg serverConfig, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(cfg.KeepAlives)
+	return server
+}
+
+// serverTimeoutMiddleware replaces the read and write deadlines set by the
+// server with those of the current configuration, so that reloaded timeouts
+// apply to the following requests. The deadlines start when the handler is
+// called.
+func (app *application) serverTimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.currentConfig().Server
+		timeouts := routeTimeoutConfig{ReadTimeout: &cfg.ReadTimeout, WriteTimeout: &cfg.WriteTimeout}
+		routeTimeoutMiddleware(timeouts, next.ServeHTTP)(w, r)
+	})
+}
+
+// liveRouteTimeoutMiddleware applies the timeouts of the route registered
+// with the pattern in the current configuration, if there are any.
+func (app *application) liveRouteTimeoutMiddleware(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := app.currentConfig()
+		if cfg == nil {
+			next(w, r)
+			return
+		}
+		timeouts, ok := cfg.Server.Routes[pattern]
+		if !ok {
+			next(w, r)
+			return
+		}
+		routeTimeoutMiddleware(timeouts, next)(w, r)
+	}
+}
+
+// routeTimeoutMiddleware replaces the read and write deadlines set by the
+// server for the requests of a route, e.g. to give exports and streams more
+// time. The deadlines start when the handler is called.
+func routeTimeoutMiddleware(cfg routeTimeoutConfig, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if cfg.ReadTimeout != nil {
+			if err := rc.SetReadDeadline(deadline(*cfg.ReadTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				requestLogger(r).Error("Failed to set read deadline", "error", err)
+			}
+		}
+		if cfg.WriteTimeout != nil {
+			if err := rc.SetWriteDeadline(deadline(*cfg.WriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				requestLogger(r).Error("Failed to set write deadline", "error", err)
+			}
+		}
+		next(w, r)
+	}
+}
+
+// deadline returns the deadline of a timeout starting now, the zero time,
+// which means no deadline, when the timeout is zero.
+func deadline(timeout duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(timeout))
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const sessionCookieName = "session"
+
+var errSessionNotFound = errors.New("session not found")
+
+type session struct {
+	ID       string
+	Username string
+	// DisplayName is shown instead of the username when set, for users of
+	// an identity provider.
+	DisplayName string
+	// Role overrides the role configured for the user, it's set when the
+	// role comes from an identity provider.
+	Role      string
+	CreatedAt time.Time
+	LastSeen  time.Time
+}
+
+// sessionStore keeps server-side web UI sessions. Session expiry is decided
+// by the caller, the store only persists them.
+type sessionStore interface {
+	create(ctx context.Context, s session) error
+	get(ctx context.Context, id string) (session, error)
+	touch(ctx context.Context, id string, lastSeen time.Time) error
+	delete(ctx context.Context, id string) error
+	// deleteExpired removes the sessions last seen before lastSeenBefore or
+	// created before createdBefore.
+	deleteExpired(ctx context.Context, lastSeenBefore, createdBefore time.Time) error
+}
+
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: map[string]session{}}
+}
+
+func (s *memorySessionStore) create(ctx context.Context, sess session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *memorySessionStore) get(ctx context.Context, id string) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, exists := s.sessions[id]
+	if !exists {
+		return session{}, errSessionNotFound
+	}
+	return sess, nil
+}
+
+func (s *memorySessionStore) touch(ctx context.Context, id string, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, exists := s.sessions[id]
+	if !exists {
+		return errSessionNotFound
+	}
+	sess.LastSeen = lastSeen
+	s.sessions[id] = sess
+	return nil
+}
+
+func (s *memorySessionStore) delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) deleteExpired(ctx context.Context, lastSeenBefore, createdBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, sess := range s.sessions {
+		if sess.LastSeen.Before(lastSeenBefore) || sess.CreatedAt.Before(createdBefore) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+type postgresSessionStore struct {
+	db *pgxpool.Pool
+}
+
+func (s *postgresSessionStore) create(ctx context.Context, sess session) error {
+	_, err := s.db.Exec(ctx, "INSERT INTO sessions(id, username, display_name, role, created_at, last_seen) VALUES ($1, $2, $3, $4, $5, $6)",
+		sess.ID, sess.Username, sess.DisplayName, sess.Role, sess.CreatedAt, sess.LastSeen,
+	)
+	return err
+}
+
+func (s *postgresSessionStore) get(ctx context.Context, id string) (session, error) {
+	var sess session
+	err := s.db.QueryRow(ctx, "SELECT id, username, display_name, role, created_at, last_seen FROM sessions WHERE id = $1", id).Scan(
+		&sess.ID, &sess.Username, &sess.DisplayName, &sess.Role, &sess.CreatedAt, &sess.LastSeen,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return session{}, errSessionNotFound
+	}
+	return sess, err
+}
+
+func (s *postgresSessionStore) touch(ctx context.Context, id string, lastSeen time.Time) error {
+	_, err := s.db.Exec(ctx, "UPDATE sessions SET last_seen = $1 WHERE id = $2", lastSeen, id)
+	return err
+}
+
+func (s *postgresSessionStore) delete(ctx context.Context, id string) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM sessions WHERE id = $1", id)
+	return err
+}
+
+func (s *postgresSessionStore) deleteExpired(ctx context.Context, lastSeenBefore, createdBefore time.Time) error {
+	_, err := s.db.Exec(ctx, "DELETE FROM sessions WHERE last_seen < $1 OR created_at < $2", lastSeenBefore, createdBefore)
+	return err
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate session id: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sessionUser returns the name to display for the session attached to the
+// request, or an empty string if there is no valid session.
+func (app *application) sessionUser(r *http.Request) string {
+	sess, ok := app.currentSession(r)
+	if !ok {
+		return ""
+	}
+	return cmp.Or(sess.DisplayName, sess.Username)
+}
+
+// currentSession returns the valid session attached to the request, if there
+// is one. Expired sessions are removed from the store.
+func (app *application) currentSession(r *http.Request) (session, bool) {
+	if app.sessions == nil {
+		return session{}, false
+	}
+
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return session{}, false
+	}
+
+	sess, err := app.sessions.get(r.Context(), cookie.Value)
+	if err != nil {
+		if !errors.Is(err, errSessionNotFound) {
+			requestLogger(r).Error("Failed to get session", "error", err)
+		}
+		return session{}, false
+	}
+
+	now := time.Now()
+	if now.Sub(sess.LastSeen) > time.Duration(app.sessionConfig.IdleTimeout) ||
+		now.Sub(sess.CreatedAt) > time.Duration(app.sessionConfig.AbsoluteTimeout) {
+		if err := app.sessions.delete(r.Context(), sess.ID); err != nil {
+			requestLogger(r).Error("Failed to delete expired session", "error", err)
+		}
+		return session{}, false
+	}
+
+	if err := app.sessions.touch(r.Context(), sess.ID, now); err != nil {
+		requestLogger(r).Error("Failed to update session", "error", err)
+	}
+
+	return sess, true
+}
+
+// startSession creates a new session for the user and sets its cookie. The
+// session is rotated: a session attached to the request is deleted, so that
+// a session id planted before authentication can't be reused afterwards.
+// Sessions that expired without coming back are removed along the way.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, sess session) error {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := app.sessions.delete(r.Context(), cookie.Value); err != nil {
+			requestLogger(r).Error("Failed to delete previous session", "error", err)
+		}
+	}
+
+	now := time.Now()
+	err := app.sessions.deleteExpired(r.Context(),
+		now.Add(-time.Duration(app.sessionConfig.IdleTimeout)),
+		now.Add(-time.Duration(app.sessionConfig.AbsoluteTimeout)),
+	)
+	if err != nil {
+		requestLogger(r).Error("Failed to delete expired sessions", "error", err)
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+
+	sess.ID = id
+	sess.CreatedAt = now
+	sess.LastSeen = now
+	err = app.sessions.create(r.Context(), sess)
+	if err != nil {
+		return fmt.Errorf("store session: %v", err)
+	}
+
+	app.setSessionCookie(w, id)
+	return nil
+}
+
+func (app *application) setSessionCookie(w http.ResponseWriter, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(time.Duration(app.sessionConfig.AbsoluteTimeout).Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type loginPageData struct {
+	Error       string
+	OIDCEnabled bool
+	CSRFToken   string
+}
+
+func (app *application) loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	if app.sessionUser(r) != "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.renderLoginPage(w, r, http.StatusOK, "")
+}
+
+func (app *application) renderLoginPage(w http.ResponseWriter, r *http.Request, status int, errorMessage string) {
+	data := loginPageData{
+		Error:       errorMessage,
+		OIDCEnabled: app.enabledModules["oidc"],
+		CSRFToken:   csrfToken(w, r),
+	}
+
+	tmpl, err := template.ParseFiles("./static/login.html")
+	if err != nil {
+		requestLogger(r).Error("Failed to load template", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	w.WriteHeader(status)
+
+	if err := tmpl.Execute(w, data); err != nil {
+		requestLogger(r).Error("Failed to render template", "error", err)
+		return
+	}
+}
+
+func (app *application) loginHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+
+	if err := app.verifyPassword(r, username, password); err != nil {
+		if retryAfter, ok := retryAfterFromError(err); ok {
+			setRetryAfter(w, retryAfter)
+			app.renderLoginPage(w, r, http.StatusTooManyRequests, "Too many failed attempts, please try again later")
+			return
+		}
+		if errors.Is(err, errInvalidCredentials) {
+			app.renderLoginPage(w, r, http.StatusUnauthorized, "Invalid username or password")
+			return
+		}
+		requestLogger(r).Error("Failed to verify password", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	if err := app.startSession(w, r, session{Username: username}); err != nil {
+		requestLogger(r).Error("Failed to create session", "error", err)
+		writeProblem(w, r, http.StatusInternalServerError, "")
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := app.sessions.delete(r.Context(), cookie.Value); err != nil {
+			requestLogger(r).Error("Failed to delete session", "error", err)
+			writeProblem(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	}
+
+	clearSessionCookie(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// shutdownCoordinator releases resources once the server stopped serving
+// requests. The server has no long-lived connections, like server-sent
+// events or WebSockets, that http.Server.Shutdown doesn't wait for; their
+// handlers would need to be told to finish.
+type shutdownCoordinator struct {
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+func newShutdownCoordinator() *shutdownCoordinator {
+	return &shutdownCoordinator{}
+}
+
+// onShutdown registers a hook. Hooks run in reverse order of registration,
+// like deferred calls, so that resources acquired first, like the database
+// pool, are released last.
+func (s *shutdownCoordinator) onShutdown(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hooks = append(s.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// runHooks runs every hook, even when earlier ones fail. Each hook gets its
+// own timeout, so that draining requests or a hanging hook don't leave the
+// others without time.
+func (s *shutdownCoordinator) runHooks(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.hooks) - 1; i >= 0; i-- {
+		hook := s.hooks[i]
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := hook.fn(ctx)
+		cancel()
+		if err != nil {
+			slog.Error("Shutdown hook failed", "hook", hook.name, "error", err)
+			continue
+		}
+		slog.Debug("Shutdown hook done", "hook", hook.name)
+	}
+	s.hooks = nil
+}
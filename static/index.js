@@ -20,6 +20,7 @@ document
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        "X-CSRF-Token": document.querySelector('meta[name="csrf-token"]').content,
       },
       body: JSON.stringify({ author: author, message: message }),
     })
@@ -28,8 +29,13 @@ document
           localStorage.setItem("author", author)
           document.getElementById("message").value = ""
           window.location.reload()
+        } else if (response.status === 401) {
+          window.location.href = "/login"
         } else {
-          alert("Failed to add post")
+          response
+            .json()
+            .then((problem) => alert(problem.detail || problem.title))
+            .catch(() => alert("Failed to add post"))
         }
       })
       .catch((error) => {
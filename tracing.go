@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the server. It doesn't record anything until
+// newTracerProvider installs a provider, so spans can be started whether the
+// tracing module is enabled or not.
+var tracer = otel.Tracer("github.com/chtozamm/http-server")
+
+// newTracerProvider installs a tracer provider exporting spans as configured,
+// and W3C Trace Context propagation.
+func newTracerProvider(ctx context.Context, cfg tracingConfig) (*sdktrace.TracerProvider, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s exporter: %v", cfg.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+		// Follow the decision of the caller when the request is part of a
+		// trace already
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return provider, nil
+}
+
+func (cfg tracingConfig) validate() error {
+	if cfg.Exporter != "otlp" && cfg.Exporter != "stdout" {
+		return fmt.Errorf("invalid exporter %q (must be otlp or stdout)", cfg.Exporter)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("invalid sample ratio %v (must be between 0 and 1)", cfg.SampleRatio)
+	}
+	return nil
+}
+
+// tracingMiddleware starts a span for every request, continuing the trace of
+// the traceparent header. It must be wrapped by requestLoggerMiddleware, which
+// collects the route pattern the span is named after.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(clientIP(r)),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		if sc := span.SpanContext(); sc.IsValid() {
+			ctx = context.WithValue(ctx, loggerContextKey{}, loggerFromContext(ctx).With("trace_id", sc.TraceID().String()))
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if info := logInfoFromContext(ctx); info != nil && info.pattern != "" && info.pattern != "/" {
+			span.SetName(info.pattern)
+			span.SetAttributes(semconv.HTTPRoute(info.pattern))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.statusCode))
+		if rec.statusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.statusCode))
+		}
+	})
+}
+
+// queryTracer creates a child span of the request for every database query.
+type queryTracer struct{}
+
+func (queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, _ = tracer.Start(ctx, "query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBQueryText(data.SQL),
+		),
+	)
+	return ctx
+}
+
+func (queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	defer span.End()
+
+	if data.Err != nil {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, data.Err.Error())
+		return
+	}
+	span.SetAttributes(attribute.Int64("db.rows_affected", data.CommandTag.RowsAffected()))
+}